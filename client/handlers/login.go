@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Servers started with -users accept commands only after LOGIN. The
+// credentials come from the environment or are asked for once at startup,
+// then they are sent on every new TCP connection and when UDP mode starts.
+// Over UDP the server answers LOGIN with a token sent with every request.
+const (
+	UserEnv     = "TRANSFER_USER"
+	PasswordEnv = "TRANSFER_PASSWORD"
+)
+
+var loginUser, loginPassword string
+
+// loginToken is issued by the server on UDP LOGIN, the source address alone proves nothing
+var loginToken string
+
+// LoginFromEnv reports whether the environment names a user to log in as
+func LoginFromEnv() bool {
+	return os.Getenv(UserEnv) != ""
+}
+
+// SetupLogin reads the credentials, prompting for those missing from the environment
+func SetupLogin(scanner *bufio.Scanner) error {
+	loginUser = os.Getenv(UserEnv)
+	if loginUser == "" {
+		fmt.Print("User: ")
+		if !scanner.Scan() {
+			return errors.New("no user name given")
+		}
+		loginUser = strings.TrimSpace(scanner.Text())
+	}
+
+	loginPassword = os.Getenv(PasswordEnv)
+	if loginPassword == "" {
+		fmt.Printf("Password for %s: ", loginUser)
+		if !scanner.Scan() {
+			return errors.New("no password given")
+		}
+		loginPassword = scanner.Text()
+	}
+
+	if loginUser == "" || loginPassword == "" {
+		return errors.New("user name and password must not be empty")
+	}
+	return nil
+}
+
+// loginTCP sends LOGIN on a new connection, the command is not logged because of the password
+func loginTCP(conn net.Conn, reader *bufio.Reader) {
+	log.Printf("Logging in as %s\n", loginUser)
+	if _, err := fmt.Fprintf(conn, "LOGIN %s %s\n", loginUser, loginPassword); err != nil {
+		fmt.Println("Error sending login:", err)
+		return
+	}
+
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading response:", err)
+		return
+	}
+	fmt.Printf("Response: %s", response)
+}
+
+// loginUDP keeps the token from the reply, UDP requests carry it instead of the password
+func loginUDP(conn *net.UDPConn) {
+	log.Printf("Logging in as %s\n", loginUser)
+	response, err := udpRequest(conn, fmt.Sprintf("LOGIN %s %s", loginUser, loginPassword))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	if reply, token, ok := strings.Cut(response, ", token "); ok {
+		response, loginToken = reply, token
+	}
+	fmt.Printf("Response: %s\n", response)
+}
+
+// withLogin prefixes a UDP request with the login token, if there is one
+func withLogin(request string) string {
+	if loginToken == "" {
+		return request
+	}
+	return "AUTH " + loginToken + " " + request
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bufio"
+	"common/transfer"
 	"fmt"
 	"io"
 	"log"
@@ -12,8 +13,13 @@ import (
 	"time"
 )
 
+// tcpServerAddr is the address HandleTCPCommands dialed, a redirect to a
+// bare port stays on its host
+var tcpServerAddr string
+
 func HandleTCPCommands(tcpAddr string, scanner *bufio.Scanner) {
-	conn, err := net.Dial("tcp", tcpAddr)
+	tcpServerAddr = tcpAddr
+	conn, err := dialTCP(tcpAddr)
 	if err != nil {
 		log.Fatal("Error connecting to TCP:", err)
 		return
@@ -38,13 +44,22 @@ func HandleTCPCommands(tcpAddr string, scanner *bufio.Scanner) {
 		log.Println("Successfully redirected to child server")
 	}
 
+	if loginUser != "" {
+		loginTCP(conn, reader)
+	}
+
 	for {
 		fmt.Println("\nTCP Commands:")
 		fmt.Println("1. ECHO <message>")
 		fmt.Println("2. TIME")
 		fmt.Println("3. UPLOAD <filename>")
 		fmt.Println("4. DOWNLOAD <filename>")
-		fmt.Println("5. Back to protocol selection")
+		fmt.Println("5. LIST [directory]")
+		fmt.Println("6. STAT <filename>")
+		fmt.Println("7. DELETE <filename>")
+		fmt.Println("8. RENAME <from> <to>")
+		fmt.Println("9. MKDIR <directory>")
+		fmt.Println("0. Back to protocol selection")
 		fmt.Print("Enter command: ")
 
 		if !scanner.Scan() {
@@ -52,7 +67,7 @@ func HandleTCPCommands(tcpAddr string, scanner *bufio.Scanner) {
 		}
 		cmd := scanner.Text()
 
-		if cmd == "5" {
+		if cmd == "0" {
 			return
 		}
 
@@ -102,6 +117,49 @@ func HandleTCPCommands(tcpAddr string, scanner *bufio.Scanner) {
 			}
 			downloadFileTCP(conn, reader, filename)
 
+		case "5", "LIST":
+			dir := "."
+			if len(parts) > 1 {
+				dir = parts[1]
+			}
+			listTCP(conn, reader, "LIST "+dir)
+
+		case "6", "STAT":
+			filename, ok := readArgument(parts, scanner, "Enter filename to stat: ")
+			if !ok {
+				return
+			}
+			sendTCPCommand(conn, reader, "STAT "+filename)
+
+		case "7", "DELETE":
+			filename, ok := readArgument(parts, scanner, "Enter filename to delete: ")
+			if !ok {
+				return
+			}
+			sendTCPCommand(conn, reader, "DELETE "+filename)
+
+		case "8", "RENAME":
+			from, ok := readArgument(parts, scanner, "Enter filename to rename: ")
+			if !ok {
+				return
+			}
+			names := strings.Fields(from)
+			if len(names) < 2 {
+				fmt.Print("Enter new name: ")
+				if !scanner.Scan() {
+					return
+				}
+				names = append(names[:1], scanner.Text())
+			}
+			sendTCPCommand(conn, reader, "RENAME "+names[0]+" "+names[1])
+
+		case "9", "MKDIR":
+			dir, ok := readArgument(parts, scanner, "Enter directory to create: ")
+			if !ok {
+				return
+			}
+			sendTCPCommand(conn, reader, "MKDIR "+dir)
+
 		default:
 			fmt.Println("Unknown command")
 		}
@@ -130,46 +188,7 @@ func checkForRedirect(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
 
 	// Проверяем, содержит ли ответ команду редиректа
 	if strings.HasPrefix(response, "REDIRECT") {
-		parts := strings.Fields(response)
-		if len(parts) < 2 {
-			return nil, fmt.Errorf("invalid redirect format: %s", response)
-		}
-
-		// Получаем новый порт
-		port, err := strconv.Atoi(strings.TrimSpace(parts[1]))
-		if err != nil {
-			return nil, fmt.Errorf("invalid port in redirect: %s", parts[1])
-		}
-
-		// Используем 127.0.0.1 для локального соединения
-		host := "127.0.0.1" // Всегда используем IP-адрес вместо hostname
-
-		// Создаем новое соединение к дочернему серверу
-		log.Printf("Redirecting to %s:%d...\n", host, port)
-
-		// Закрываем текущее соединение перед созданием нового
-		conn.Close()
-
-		// Добавляем задержку перед подключением к новому порту
-		time.Sleep(500 * time.Millisecond)
-
-		newConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-		if err != nil {
-			return nil, fmt.Errorf("failed to connect to redirected server: %v", err)
-		}
-
-		log.Printf("Connected to redirected server at %s:%d\n", host, port)
-
-		// Читаем приветственное сообщение от дочернего сервера
-		welcomeMsg, err := bufio.NewReader(newConn).ReadString('\n')
-		if err != nil {
-			log.Printf("Warning: Failed to read welcome message: %v", err)
-			// Продолжаем работу даже при ошибке чтения приветствия
-		} else {
-			log.Printf("Received welcome message: %q", welcomeMsg)
-		}
-
-		return newConn, nil
+		return handleRedirect(conn, response)
 	}
 
 	log.Println("No redirect in response")
@@ -178,7 +197,7 @@ func checkForRedirect(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
 
 func sendTCPCommand(conn net.Conn, reader *bufio.Reader, command string) {
 	log.Printf("Sending command: %q\n", command)
-	_, err := fmt.Fprintf(conn, command+"\n")
+	_, err := fmt.Fprint(conn, command+"\n")
 	if err != nil {
 		fmt.Println("Error sending command:", err)
 		return
@@ -208,6 +227,42 @@ func sendTCPCommand(conn net.Conn, reader *bufio.Reader, command string) {
 	fmt.Printf("Response: %s", response)
 }
 
+// readArgument returns the argument typed after the command or asks for it
+func readArgument(parts []string, scanner *bufio.Scanner, prompt string) (string, bool) {
+	if len(parts) > 1 {
+		return parts[1], true
+	}
+	fmt.Print(prompt)
+	if !scanner.Scan() {
+		return "", false
+	}
+	return scanner.Text(), true
+}
+
+// listTCP prints the directory listing, which ends with an END line
+func listTCP(conn net.Conn, reader *bufio.Reader, command string) {
+	log.Printf("Sending command: %q\n", command)
+	if _, err := fmt.Fprint(conn, command+"\n"); err != nil {
+		fmt.Println("Error sending command:", err)
+		return
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println("Error reading response:", err)
+			return
+		}
+		if line == "END\n" {
+			return
+		}
+		fmt.Print(line)
+		if strings.HasPrefix(line, "List failed") {
+			return
+		}
+	}
+}
+
 func uploadFileTCP(conn net.Conn, reader *bufio.Reader, filename string) {
 	startTime := time.Now() // Засекаем время начала передачи
 
@@ -251,33 +306,42 @@ func uploadFileTCP(conn net.Conn, reader *bufio.Reader, filename string) {
 	}
 
 	fmt.Print(response)
+	if !strings.HasPrefix(response, "Ready to receive") {
+		return
+	}
 
-	buffer := make([]byte, 4096)
-	totalSent := 0
-
-	for {
-		n, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fmt.Println("Error reading file:", err)
-			return
-		}
-
-		time.Sleep(time.Nanosecond * 10000 * 15)
-		_, err = conn.Write(buffer[:n])
-		if err != nil {
-			fmt.Println("Error sending file data:", err)
-			return
-		}
-
-		totalSent += n
+	// Сервер сообщает, сколько байт у него уже есть от прошлой попытки
+	offset, err := replyOffset(response)
+	if err != nil || offset > fileInfo.Size() {
+		fmt.Println("Invalid resume offset from server:", strings.TrimSpace(response))
+		return
+	}
+	if offset > 0 {
+		fmt.Printf("Resuming upload of '%s' from %d bytes\n", filename, offset)
 	}
 
-	_, err = conn.Write([]byte("EOF\n"))
+	// SHA-256 считается по всему файлу, включая часть, отправленную раньше
+	hasher, err := transfer.HashFile(file, offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
 	if err != nil {
-		fmt.Println("Error signaling end of file:", err)
+		fmt.Println("Error reading file:", err)
+		return
+	}
+
+	// Данные файла уходят кадрами с длиной, поэтому содержимое может быть любым,
+	// после них отправляем SHA-256, сервер сверит его с записанным
+	writer := bufio.NewWriter(conn)
+	if _, err := transfer.WriteFrames(writer, io.TeeReader(file, hasher)); err != nil {
+		fmt.Println("Error sending file data:", err)
+		fmt.Println("Connection lost, run UPLOAD again to resume")
+		return
+	}
+	fmt.Fprintf(writer, "%s\n", transfer.FormatDigest(hasher))
+	if err := writer.Flush(); err != nil {
+		fmt.Println("Error sending file data:", err)
+		fmt.Println("Connection lost, run UPLOAD again to resume")
 		return
 	}
 
@@ -287,9 +351,18 @@ func uploadFileTCP(conn net.Conn, reader *bufio.Reader, filename string) {
 		return
 	}
 
+	if strings.Contains(response, transfer.DigestMismatch) {
+		fmt.Printf("UPLOAD FAILED: '%s' was corrupted in transit, the server discarded it\n%s", filename, response)
+		return
+	}
+	if !strings.Contains(response, transfer.DigestOK) {
+		fmt.Printf("UPLOAD FAILED: %s", response)
+		return
+	}
+
 	// Расчет битрейта
 	elapsed := time.Since(startTime).Seconds()
-	bitrate := float64(fileInfo.Size()) / (1024 * 1024 * elapsed) // в МБ/с
+	bitrate := float64(fileInfo.Size()-offset) / (1024 * 1024 * elapsed) // в МБ/с
 
 	fmt.Printf("%sBitrate: %.2f MB/s\n", response, bitrate)
 }
@@ -297,9 +370,26 @@ func uploadFileTCP(conn net.Conn, reader *bufio.Reader, filename string) {
 func downloadFileTCP(conn net.Conn, reader *bufio.Reader, filename string) {
 	startTime := time.Now() // Засекаем время начала скачивания
 
-	command := fmt.Sprintf("DOWNLOAD %s\n", filename)
+	// Пишем во временный файл, под своим именем он появится только после сверки хеша.
+	// Если он остался от оборванной попытки, просим сервер продолжить с его длины
+	tempFilename := filename + ".part"
+	outFile, err := os.OpenFile(tempFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Println("Error creating file:", err)
+		return
+	}
+	defer removeEmptyPartial(tempFilename)
+	defer outFile.Close()
+
+	partInfo, err := outFile.Stat()
+	if err != nil {
+		fmt.Println("Error reading partial download:", err)
+		return
+	}
+
+	command := fmt.Sprintf("DOWNLOAD %s %d\n", filename, partInfo.Size())
 	log.Printf("Sending download command: %q\n", command)
-	_, err := conn.Write([]byte(command))
+	_, err = conn.Write([]byte(command))
 	if err != nil {
 		fmt.Println("Error sending download command:", err)
 		return
@@ -319,6 +409,7 @@ func downloadFileTCP(conn net.Conn, reader *bufio.Reader, filename string) {
 			fmt.Println("Error handling redirect:", err)
 			return
 		}
+		outFile.Close()
 		downloadFileTCP(newConn, bufio.NewReader(newConn), filename)
 		return
 	}
@@ -330,68 +421,95 @@ func downloadFileTCP(conn net.Conn, reader *bufio.Reader, filename string) {
 
 	fmt.Print(response)
 
-	outFile, err := os.Create(filename)
+	// Сервер начинает заново, если файл у него стал короче нашей части
+	offset, err := replyOffset(response)
+	if err != nil || offset > partInfo.Size() {
+		fmt.Println("Invalid resume offset from server:", strings.TrimSpace(response))
+		return
+	}
+	if offset > 0 {
+		fmt.Printf("Resuming download of '%s' from %d bytes\n", filename, offset)
+	}
+
+	hasher, err := transfer.HashFile(outFile, offset)
+	if err == nil {
+		err = outFile.Truncate(offset)
+	}
+	if err == nil {
+		_, err = outFile.Seek(offset, io.SeekStart)
+	}
 	if err != nil {
-		fmt.Println("Error creating file:", err)
+		fmt.Println("Error reading partial download:", err)
 		return
 	}
-	defer outFile.Close()
 
-	fileContent := make([]byte, 4096)
-	eof := false
-	totalReceived := 0
+	totalReceived, writeErr, err := transfer.ReadFrames(reader, io.MultiWriter(outFile, hasher))
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		fmt.Printf("Connection lost, %d bytes kept in %s, run DOWNLOAD again to resume\n", offset+totalReceived, tempFilename)
+		return
+	}
 
-	for !eof {
-		time.Sleep(time.Nanosecond * 10000 * 15)
-		n, err := reader.Read(fileContent)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fmt.Println("Error reading from connection:", err)
-			return
-		}
+	digestLine, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return
+	}
+	if writeErr != nil {
+		fmt.Fprintf(conn, "%s\n", transfer.DigestMismatch)
+		fmt.Println("Error writing to file:", writeErr)
+		return
+	}
 
-		data := fileContent[:n]
-		if n >= 4 && string(data[n-4:n]) == "EOF\n" {
-			_, err = outFile.Write(data[:n-4])
-			totalReceived += n - 4
-			eof = true
-		} else {
-			_, err = outFile.Write(data)
-			totalReceived += n
-		}
+	received := transfer.FormatDigest(hasher)
+	if expected, err := transfer.ParseDigest(digestLine); err != nil || received != transfer.DigestPrefix+expected {
+		fmt.Fprintf(conn, "%s %s\n", transfer.DigestMismatch, strings.TrimPrefix(received, transfer.DigestPrefix))
+		fmt.Printf("DOWNLOAD FAILED: '%s' does not match the server's SHA-256, data kept in %s (delete it to download from scratch)\n", filename, tempFilename)
+		return
+	}
+	fmt.Fprintf(conn, "%s\n", transfer.DigestOK)
 
-		if err != nil {
-			fmt.Println("Error writing to file:", err)
-			return
-		}
+	outFile.Close()
+	if err := os.Rename(tempFilename, filename); err != nil {
+		fmt.Println("Error renaming temporary file:", err)
+		return
 	}
 
 	elapsed := time.Since(startTime).Seconds()
 	bitrate := float64(totalReceived) / (1024 * 1024 * elapsed) // в МБ/с
 
-	fmt.Printf("File '%s' downloaded successfully\nBitrate: %.2f MB/s\n", filename, bitrate)
+	fmt.Printf("File '%s' downloaded successfully, SHA-256 verified\nBitrate: %.2f MB/s\n", filename, bitrate)
 }
 
-// Функция для обработки редиректа
-func handleRedirect(conn net.Conn, redirectMessage string) (net.Conn, error) {
-	parts := strings.Fields(redirectMessage)
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid redirect format: %s", redirectMessage)
+// removeEmptyPartial deletes a partial file that a failed download left
+// empty, a failed request must not leave files behind. It runs after the
+// file is closed, and after a successful download the file is already renamed.
+func removeEmptyPartial(path string) {
+	if info, err := os.Stat(path); err == nil && info.Size() == 0 {
+		os.Remove(path)
 	}
+}
 
-	// Получаем новый порт
-	port, err := strconv.Atoi(strings.TrimSpace(parts[1]))
-	if err != nil {
-		return nil, fmt.Errorf("invalid port in redirect: %s", parts[1])
+// replyOffset extracts the resume offset from a "... from offset N" reply,
+// servers that do not resume omit it
+func replyOffset(response string) (int64, error) {
+	const marker = " from offset "
+	i := strings.LastIndex(response, marker)
+	if i < 0 {
+		return 0, nil
 	}
+	return strconv.ParseInt(strings.TrimSpace(response[i+len(marker):]), 10, 64)
+}
 
-	// Всегда используем 127.0.0.1 для локального подключения
-	host := "127.0.0.1"
+// Функция для обработки редиректа
+func handleRedirect(conn net.Conn, redirectMessage string) (net.Conn, error) {
+	target, err := redirectTarget(redirectMessage)
+	if err != nil {
+		return nil, err
+	}
 
 	// Создаем новое соединение к дочернему серверу
-	log.Printf("Redirecting to %s:%d...\n", host, port)
+	log.Printf("Redirecting to %s...\n", target)
 
 	// Закрываем текущее соединение
 	conn.Close()
@@ -399,12 +517,12 @@ func handleRedirect(conn net.Conn, redirectMessage string) (net.Conn, error) {
 	// Небольшая задержка перед новым подключением
 	time.Sleep(500 * time.Millisecond)
 
-	newConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	newConn, err := dialTCP(target)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to redirected server: %v", err)
 	}
 
-	log.Printf("Connected to redirected server at %s:%d\n", host, port)
+	log.Printf("Connected to redirected server at %s\n", target)
 
 	// Читаем приветственное сообщение от дочернего сервера
 	welcomeMsg, err := bufio.NewReader(newConn).ReadString('\n')
@@ -417,3 +535,27 @@ func handleRedirect(conn net.Conn, redirectMessage string) (net.Conn, error) {
 
 	return newConn, nil
 }
+
+// redirectTarget reads "REDIRECT <port>" or "REDIRECT <host:port>". A bare
+// port is on the host the client dialed, so the client never assumes the
+// balancer is local.
+func redirectTarget(message string) (string, error) {
+	parts := strings.Fields(message)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("invalid redirect format: %s", message)
+	}
+
+	target := parts[1]
+	if _, err := strconv.Atoi(target); err == nil {
+		host, _, err := net.SplitHostPort(tcpServerAddr)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, target), nil
+	}
+
+	if _, port, err := net.SplitHostPort(target); err != nil || port == "" {
+		return "", fmt.Errorf("invalid redirect target: %s", target)
+	}
+	return target, nil
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"common/tlsconfig"
+	"crypto/tls"
+	"net"
+)
+
+// TLSConfig secures the TCP command channel when set by SetupTLS
+var TLSConfig *tls.Config
+
+// SetupTLS enables TLS for TCP connections. caFile adds a CA to trust
+// instead of the system roots, certFile and keyFile give the client
+// certificate for servers that require one, serverName overrides the name
+// checked against the server certificate.
+func SetupTLS(caFile, certFile, keyFile, serverName string) error {
+	config, err := tlsconfig.Client(caFile, certFile, keyFile, serverName)
+	if err != nil {
+		return err
+	}
+	TLSConfig = config
+	return nil
+}
+
+// dialTCP connects to a server or a child server of the load balancer
+func dialTCP(addr string) (net.Conn, error) {
+	if TLSConfig == nil {
+		return net.Dial("tcp", addr)
+	}
+	return tls.Dial("tcp", addr, TLSConfig)
+}
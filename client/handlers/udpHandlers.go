@@ -2,7 +2,8 @@ package handlers
 
 import (
 	"bufio"
-	"encoding/binary"
+	"common/transfer"
+	"common/udp"
 	"fmt"
 	"log"
 	"net"
@@ -13,10 +14,10 @@ import (
 )
 
 const (
-	DatagramSize  = 1500             // Recommended datagram size per ethernet mtu limitations (1500 bytes)
-	SlidingWindow = 8                // We will receive ACK for 3 packages
-	BuffSize      = 64 * 1024 * 1024 // 64 MBs
-	Timeout       = time.Millisecond * 100
+	BuffSize = 64 * 1024 * 1024 // 64 MBs
+	Timeout  = time.Millisecond * 100
+
+	MaxResponseSize = 64 * 1024 // Command replies such as LIST may be larger than one chunk
 )
 
 func ProgressBar(current, total int, operation string) {
@@ -52,13 +53,22 @@ func HandleUDPCommands(udpAddr string, scanner *bufio.Scanner) {
 	defer conn.Close()
 	log.Println("UDP connected to", udpAddr)
 
+	if loginUser != "" {
+		loginUDP(conn)
+	}
+
 	for {
 		fmt.Println("\nUDP Commands:")
 		fmt.Println("1. ECHO <message>")
 		fmt.Println("2. TIME")
 		fmt.Println("3. UPLOAD <filename>")
 		fmt.Println("4. DOWNLOAD <filename>")
-		fmt.Println("5. Back to protocol selection")
+		fmt.Println("5. LIST [directory]")
+		fmt.Println("6. STAT <filename>")
+		fmt.Println("7. DELETE <filename>")
+		fmt.Println("8. RENAME <from> <to>")
+		fmt.Println("9. MKDIR <directory>")
+		fmt.Println("0. Back to protocol selection")
 		fmt.Print("Enter command: ")
 
 		if !scanner.Scan() {
@@ -66,7 +76,7 @@ func HandleUDPCommands(udpAddr string, scanner *bufio.Scanner) {
 		}
 		cmd := scanner.Text()
 
-		if cmd == "5" {
+		if cmd == "0" {
 			return
 		}
 
@@ -116,6 +126,49 @@ func HandleUDPCommands(udpAddr string, scanner *bufio.Scanner) {
 			}
 			downloadFileUDP(conn, filename)
 
+		case "5", "LIST":
+			dir := "."
+			if len(parts) > 1 {
+				dir = parts[1]
+			}
+			sendUDPCommand(conn, "LIST "+dir)
+
+		case "6", "STAT":
+			filename, ok := readArgument(parts, scanner, "Enter filename to stat: ")
+			if !ok {
+				return
+			}
+			sendUDPCommand(conn, "STAT "+filename)
+
+		case "7", "DELETE":
+			filename, ok := readArgument(parts, scanner, "Enter filename to delete: ")
+			if !ok {
+				return
+			}
+			sendUDPCommand(conn, "DELETE "+filename)
+
+		case "8", "RENAME":
+			from, ok := readArgument(parts, scanner, "Enter filename to rename: ")
+			if !ok {
+				return
+			}
+			names := strings.Fields(from)
+			if len(names) < 2 {
+				fmt.Print("Enter new name: ")
+				if !scanner.Scan() {
+					return
+				}
+				names = append(names[:1], scanner.Text())
+			}
+			sendUDPCommand(conn, "RENAME "+names[0]+" "+names[1])
+
+		case "9", "MKDIR":
+			dir, ok := readArgument(parts, scanner, "Enter directory to create: ")
+			if !ok {
+				return
+			}
+			sendUDPCommand(conn, "MKDIR "+dir)
+
 		default:
 			fmt.Println("Unknown command")
 		}
@@ -123,266 +176,183 @@ func HandleUDPCommands(udpAddr string, scanner *bufio.Scanner) {
 }
 
 func sendUDPCommand(conn *net.UDPConn, command string) {
-	_, err := conn.Write([]byte(command))
+	response, err := udpRequest(conn, command)
 	if err != nil {
-		fmt.Println("Error sending command:", err)
+		fmt.Println("Error:", err)
 		return
 	}
+	fmt.Printf("Response: %s\n", response)
+}
 
-	response := make([]byte, DatagramSize)
-	n, _, err := conn.ReadFromUDP(response)
-	if err != nil {
-		fmt.Println("Error reading response:", err)
-		return
+// udpRequest sends a text command and returns the reply, sealed in a session
+// of its own when PreSharedKey is loaded
+func udpRequest(conn *net.UDPConn, command string) (string, error) {
+	command = withLogin(command)
+	if udp.PreSharedKey != nil {
+		return runCommand(conn, command)
 	}
 
-	fmt.Printf("Response: %s\n", response[:n])
-}
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return "", fmt.Errorf("sending command: %v", err)
+	}
 
-func uploadFileUDP(conn *net.UDPConn, filename string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetReadDeadline(time.Time{})
 
-	start := time.Now()
-	globalTimeout := 5 * time.Minute // Максимальное время выполнения всей операции
-	lastActivity := time.Now()
-
-	// Проверяем наличие частичной загрузки
-	tempFilename := filename + ".part"
-	var fileData []byte
-	var existingSize int
-	var err error
-
-	if _, err := os.Stat(tempFilename); err == nil {
-		fileData, err = os.ReadFile(filename)
+	response := make([]byte, MaxResponseSize)
+	for {
+		n, _, err := conn.ReadFromUDP(response)
 		if err != nil {
-			fmt.Println("Error reading original file:", err)
-			return
+			return "", fmt.Errorf("reading response: %v", err)
 		}
 
-		partInfo, err := os.Stat(tempFilename)
-		if err != nil {
-			fmt.Println("Error reading partial upload:", err)
-			return
-		}
-		existingSize = int(partInfo.Size())
-		fmt.Printf("Resuming upload of '%s' from %d bytes\n", filename, existingSize)
-	} else {
-		fileData, err = os.ReadFile(filename)
-		if err != nil {
-			fmt.Println("Error reading file:", err)
-			return
+		// Запоздавшие пакеты прошлой передачи не являются ответом на команду
+		if udp.IsTransferDatagram(response[:n]) {
+			continue
 		}
-		existingSize = 0
+		return string(response[:n]), nil
 	}
+}
 
-	fileSize := len(fileData)
-	fmt.Printf("Uploading file '%s' (%d bytes total, %d bytes remaining)\n",
-		filename, fileSize, fileSize-existingSize)
-
-	conn.SetWriteBuffer(BuffSize)
-
-	// Увеличиваем таймаут для начального ответа
-	initialTimeout := Timeout
-	conn.SetReadDeadline(time.Now().Add(initialTimeout))
+func uploadFileUDP(conn *net.UDPConn, filename string) {
+	start := time.Now()
+	globalTimeout := 5 * time.Minute // Максимальное время выполнения всей операции
+	lastActivity := time.Now()
 
-	// Отправляем команду с offset
-	uploadCmd := fmt.Sprintf("UPLOAD %s %d", filename, existingSize)
-	_, err = conn.Write([]byte(uploadCmd))
+	// Файл читается по чанкам, в памяти держим не больше окна
+	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Println("Error sending upload command:", err)
+		fmt.Println("Error reading file:", err)
 		return
 	}
+	defer file.Close()
 
-	// Проверка глобального таймаута
-	if time.Since(lastActivity) > globalTimeout {
-		fmt.Println("\nGlobal timeout exceeded, closing connection")
+	fileInfo, err := file.Stat()
+	if err != nil {
+		fmt.Println("Error reading file:", err)
 		return
 	}
+	fileSize := int(fileInfo.Size())
 
-	// Увеличиваем буфер для начального ответа
-	respBuffer := make([]byte, BuffSize)
-	n, _, err := conn.ReadFromUDP(respBuffer)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			fmt.Println("\nServer not responding, retrying...")
-			// Повторная попытка
-			conn.SetReadDeadline(time.Now().Add(initialTimeout))
-			_, err = conn.Write([]byte(uploadCmd))
-			if err != nil {
-				fmt.Println("Error resending upload command:", err)
-				return
-			}
-			n, _, err = conn.ReadFromUDP(respBuffer)
-			if err != nil {
-				fmt.Println("Server still not responding after retry")
-				return
-			}
-		} else {
-			fmt.Println("Error receiving initial response:", err)
-			return
-		}
-	}
-	lastActivity = time.Now()
+	conn.SetWriteBuffer(BuffSize)
 
-	initialResponse := string(respBuffer[:n])
-	if !strings.HasPrefix(initialResponse, "READY:") {
-		fmt.Println("Server not ready:", initialResponse)
+	// Открываем сессию передачи, сервер выдает ее ID в MsgOpenAck и сообщает,
+	// сколько байт этого файла у него уже записано подряд от прошлых попыток
+	xfer, initialResponse, err := openTransfer(conn, withLogin(fmt.Sprintf("UPLOAD %s %d", filename, fileSize)))
+	if err != nil {
+		fmt.Println("Server not ready:", err)
 		return
 	}
+	lastActivity = time.Now()
 
 	fmt.Println("Server response:", initialResponse)
 
-	numChunks := (fileSize + DatagramSize - 1) / DatagramSize
-	sentChunks := make([]bool, numChunks)
-	ackedChunks := make([]bool, numChunks)
-	startChunk := existingSize / DatagramSize
-	nextChunk := startChunk
+	var existingSize int
+	if _, err := fmt.Sscanf(initialResponse, "READY: Offset %d", &existingSize); err != nil || existingSize < 0 || existingSize > fileSize {
+		fmt.Println("Invalid resume offset from server:", initialResponse)
+		xfer.send(udp.MsgError, 0, []byte("ERROR: Invalid resume offset"))
+		return
+	}
+	if existingSize > 0 {
+		fmt.Printf("Resuming upload of '%s' from %d bytes\n", filename, existingSize)
+	}
+	fmt.Printf("Uploading file '%s' (%d bytes total, %d bytes remaining)\n",
+		filename, fileSize, fileSize-existingSize)
 
-	// Помечаем уже отправленные чанки
-	for i := 0; i < startChunk; i++ {
-		sentChunks[i] = true
-		ackedChunks[i] = true
+	remaining := fileSize - existingSize
+	numChunks := (remaining + udp.ChunkSize - 1) / udp.ChunkSize
+	loadChunk := func(seq uint32) ([]byte, error) {
+		return udp.ReadChunk(file, int64(existingSize), int64(remaining), seq)
+	}
+	sendChunk := func(seq uint32, data []byte) error {
+		return xfer.send(udp.MsgData, seq, data)
 	}
 
+	// Сервер подтверждает количество чанков, принятых по порядку, и битовую карту остальных
+	sender := udp.NewChunkSender(uint32(numChunks), udp.NewCongestionWindow(udp.SlidingWindow, udp.MaxWindow), xfer.rtt, loadChunk, sendChunk)
+
 	fmt.Println("\nUploading file:", filename)
-	fmt.Printf("Total chunks: %d, Window size: %d, Starting from chunk: %d\n",
-		numChunks, SlidingWindow, startChunk)
+	fmt.Printf("Total chunks: %d, Window size: %d-%d, Session: %08x\n",
+		numChunks, udp.SlidingWindow, udp.MaxWindow, xfer.session)
 
-	for nextChunk < numChunks || !allAcked(ackedChunks) {
+	for !sender.Done() {
 		// Проверка глобального таймаута
 		if time.Since(lastActivity) > globalTimeout {
 			fmt.Println("\nGlobal timeout exceeded, closing connection")
-			savePartialUpload(tempFilename, fileData[:nextChunk*DatagramSize])
 			return
 		}
 
-		ackedCount := countAcked(ackedChunks)
-		go ProgressBar(ackedCount*DatagramSize, fileSize, "Uploading")
-
-		// Отправляем чанки в окне
-		for i := nextChunk; i < nextChunk+SlidingWindow && i < numChunks; i++ {
-			if !sentChunks[i] {
-				startPos := i * DatagramSize
-				endPos := startPos + DatagramSize
-				if endPos > fileSize {
-					endPos = fileSize
-				}
-
-				_, err = conn.Write(fileData[startPos:endPos])
-				if err != nil {
-					savePartialUpload(tempFilename, fileData[:i*DatagramSize])
-					fmt.Println("\nError sending file chunk:", err)
-					return
-				}
+		go ProgressBar(existingSize+int(sender.Base())*udp.ChunkSize, fileSize, "Uploading")
 
-				sentChunks[i] = true
-				lastActivity = time.Now()
-			}
+		// Отправляем новые чанки, пока есть место в окне
+		if err := sender.Fill(); err != nil {
+			fmt.Println("\nError sending file chunk:", err)
+			return
 		}
 
-		conn.SetReadDeadline(time.Now().Add(Timeout))
-		n, _, err := conn.ReadFromUDP(respBuffer)
+		h, payload, err := xfer.read(sender.NextTimeout())
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				for i := nextChunk; i < nextChunk+SlidingWindow && i < numChunks; i++ {
-					if !ackedChunks[i] {
-						sentChunks[i] = false
-					}
-				}
-				continue
-			} else {
-				savePartialUpload(tempFilename, fileData[:nextChunk*DatagramSize])
+			if !isTimeout(err) {
 				fmt.Println("\nConnection error:", err)
 				return
 			}
-		}
-		lastActivity = time.Now()
-
-		ack := string(respBuffer[:n])
-		if strings.HasPrefix(ack, "ACK:") {
-			chunkIndex, err := strconv.Atoi(strings.TrimPrefix(ack, "ACK:"))
-			if err != nil {
-				fmt.Println("\nInvalid ACK received:", ack)
+			if time.Since(lastActivity) > IdleTimeout {
+				fmt.Println("\nServer stopped responding")
 				return
 			}
+		} else {
+			lastActivity = time.Now()
 
-			for i := nextChunk; i <= chunkIndex && i < numChunks; i++ {
-				ackedChunks[i] = true
+			switch h.Type {
+			case udp.MsgAck:
+				if err := sender.OnAck(h.Seq, payload); err != nil {
+					fmt.Println("\nError sending file chunk:", err)
+					return
+				}
+			case udp.MsgError:
+				fmt.Println("\nServer aborted upload:", string(payload))
+				return
 			}
+		}
 
-			if chunkIndex >= nextChunk {
-				nextChunk = chunkIndex + 1
-			}
+		// Повторяем только чанки, у которых истек таймер
+		if _, err := sender.RetransmitExpired(); err != nil {
+			fmt.Println("\nError sending file chunk:", err)
+			return
 		}
 	}
 
-	os.Remove(tempFilename)
-
-	_, err = conn.Write([]byte("EOF"))
+	// Все чанки подтверждены, закрываем сессию и передаем хеш всего файла
+	hasher, err := transfer.HashFile(file, int64(fileSize))
 	if err != nil {
-		fmt.Println("\nError sending EOF marker:", err)
+		fmt.Println("\nError hashing file:", err)
 		return
 	}
-	lastActivity = time.Now()
-
-	retries := 5
-	for i := 0; i < retries; i++ {
-		if time.Since(lastActivity) > globalTimeout {
-			fmt.Println("\nGlobal timeout exceeded during final confirmation")
-			return
-		}
-
-		conn.SetReadDeadline(time.Now().Add(Timeout))
-		n, _, err := conn.ReadFromUDP(respBuffer)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				fmt.Printf("\nRetry %d: No final response from server\n", i+1)
-				continue
-			}
-			fmt.Println("\nError receiving final response:", err)
-			break
-		}
-		lastActivity = time.Now()
-		fmt.Println("\nServer response:", string(respBuffer[:n]))
-		break
+	finalResponse, err := xfer.closeTransfer(uint32(numChunks), transfer.FormatDigest(hasher))
+	if err != nil {
+		fmt.Println("\nError finishing upload:", err)
+		return
 	}
+	fmt.Println("\nServer response:", finalResponse)
 
-	conn.SetReadDeadline(time.Time{})
+	if strings.Contains(finalResponse, transfer.DigestMismatch) {
+		fmt.Printf("UPLOAD FAILED: '%s' was corrupted in transit, the server discarded it\n", filename)
+		return
+	}
+	// Любой другой ответ без подтверждения хеша - тоже неудача
+	if !strings.HasPrefix(finalResponse, "SUCCESS") || !strings.Contains(finalResponse, transfer.DigestOK) {
+		fmt.Printf("UPLOAD FAILED: %s\n", finalResponse)
+		return
+	}
 
 	elapsed := time.Since(start).Seconds()
 	uploadedBytes := fileSize - existingSize
 	speed := float64(uploadedBytes) / (1024 * 1024 * elapsed)
-	fmt.Printf("\nFile '%s' uploaded in %.2f seconds (%.2f MB/s)\n",
-		filename, elapsed, speed)
-}
-
-func savePartialUpload(filename string, data []byte) {
-	err := os.WriteFile(filename, data, 0644)
-	if err != nil {
-		fmt.Println("Warning: failed to save upload progress:", err)
-	}
+	fmt.Printf("\nFile '%s' uploaded in %.2f seconds (%.2f MB/s, %d chunks retransmitted, %d corrupt datagrams dropped)\n",
+		filename, elapsed, speed, sender.Retransmits(), xfer.corrupt)
 }
 
-func countAcked(ackedChunks []bool) int {
-	count := 0
-	for _, acked := range ackedChunks {
-		if acked {
-			count++
-		}
-	}
-	return count
-}
-
-func allAcked(ackedChunks []bool) bool {
-	for _, acked := range ackedChunks {
-		if !acked {
-			return false
-		}
-	}
-	return true
-}
 func downloadFileUDP(conn *net.UDPConn, filename string) {
-	defer conn.SetReadDeadline(time.Time{})
 	start := time.Now()
 	conn.SetReadBuffer(BuffSize)
 
@@ -393,7 +363,7 @@ func downloadFileUDP(conn *net.UDPConn, filename string) {
 
 	if err == nil {
 		existingSize = fileInfo.Size()
-		outputFile, err = os.OpenFile(tempFilename, os.O_APPEND|os.O_WRONLY, 0644)
+		outputFile, err = os.OpenFile(tempFilename, os.O_RDWR, 0644)
 		fmt.Printf("\nResuming download from %d bytes\n", existingSize)
 	} else {
 		outputFile, err = os.Create(tempFilename)
@@ -404,26 +374,16 @@ func downloadFileUDP(conn *net.UDPConn, filename string) {
 		fmt.Println("Error opening output file:", err)
 		return
 	}
+	defer removeEmptyPartial(tempFilename)
 	defer outputFile.Close()
 
-	downloadCmd := fmt.Sprintf("DOWNLOAD %s %d", filename, existingSize)
-	_, err = conn.Write([]byte(downloadCmd))
+	xfer, response, err := openTransfer(conn, withLogin(fmt.Sprintf("DOWNLOAD %s %d", filename, existingSize)))
 	if err != nil {
-		fmt.Println("Error sending download request:", err)
-		return
-	}
-
-	fileSizeBuffer := make([]byte, DatagramSize)
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	n, _, err := conn.ReadFromUDP(fileSizeBuffer)
-	if err != nil {
-		fmt.Println("Error receiving file size:", err)
-		return
-	}
-
-	response := string(fileSizeBuffer[:n])
-	if response == "FILE_NOT_FOUND" {
-		fmt.Println("Error: File not found on server")
+		if err.Error() == "FILE_NOT_FOUND" {
+			fmt.Println("Error: File not found on server")
+		} else {
+			fmt.Println("Error starting download:", err)
+		}
 		return
 	}
 
@@ -438,89 +398,76 @@ func downloadFileUDP(conn *net.UDPConn, filename string) {
 		return
 	}
 
-	// Send ACK for file size
-	conn.Write([]byte("ACK"))
+	// Первый ACK сообщает серверу, что размер получен и можно слать данные
+	xfer.send(udp.MsgAck, 0, nil)
 
 	fmt.Printf("\nDownloading file '%s' (%d bytes total, %d bytes remaining)\n",
 		filename, fileSize, fileSize-int(existingSize))
 
-	bufWriter := bufio.NewWriterSize(outputFile, BuffSize)
-	defer bufWriter.Flush()
+	// Сервер пришлет хеш всего файла, поэтому уже скачанную часть тоже хешируем
+	hasher, err := transfer.HashFile(outputFile, existingSize)
+	if err != nil {
+		fmt.Println("Error reading partial download:", err)
+		xfer.send(udp.MsgError, 0, []byte("ERROR: Client could not read its partial file"))
+		return
+	}
 
-	buffer := make([]byte, DatagramSize+4)
-	totalBytes := int(existingSize)
-	expectedSeqNum := uint32(existingSize / int64(DatagramSize))
+	// Чанки пишутся по своим смещениям после уже скачанной части
+	receiver := udp.NewChunkReceiver(outputFile, existingSize, hasher)
 	lastProgressUpdate := time.Now()
-	//eofReceived := false
-	eofCount := 0
-
-	pendingPackets := make(map[uint32][]byte)
+	lastActivity := time.Now()
+	closed := false
 
-	for totalBytes < fileSize && eofCount < 3 {
+	for !closed {
 		if time.Since(lastProgressUpdate) > 100*time.Millisecond {
-			go ProgressBar(totalBytes, fileSize, "Downloading")
+			go ProgressBar(int(existingSize+receiver.Written()), fileSize, "Downloading")
 			lastProgressUpdate = time.Now()
 		}
 
-		conn.SetReadDeadline(time.Now().Add(Timeout))
-		n, _, err := conn.ReadFromUDP(buffer)
+		h, packetData, err := xfer.read(xfer.rtt.Timeout())
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				sendACK(conn, expectedSeqNum-1)
+			if isTimeout(err) {
+				if time.Since(lastActivity) > IdleTimeout {
+					fmt.Println("\nServer stopped sending, download interrupted")
+					return
+				}
+				// Повторяем ACK, если он потерялся, окно сервера стоит
+				xfer.send(udp.MsgAck, receiver.Next(), receiver.SackBitmap())
+				xfer.rtt.Expired()
 				continue
 			}
 			fmt.Println("\nError receiving data:", err)
 			return
 		}
+		lastActivity = time.Now()
 
-		if n >= 3 && string(buffer[:3]) == "EOF" {
-			eofCount++
-			continue
-		}
-
-		if n < 4 {
-			continue
-		}
-
-		seqNum := binary.BigEndian.Uint32(buffer[:4])
-		packetData := buffer[4:n]
-
-		if seqNum == expectedSeqNum {
-			if _, err := bufWriter.Write(packetData); err != nil {
+		switch h.Type {
+		case udp.MsgData:
+			if err := receiver.Accept(h.Seq, packetData); err != nil {
 				fmt.Println("\nError writing to file:", err)
 				return
 			}
-			totalBytes += len(packetData)
-			expectedSeqNum++
-
-			for {
-				if nextData, ok := pendingPackets[expectedSeqNum]; ok {
-					if _, err := bufWriter.Write(nextData); err != nil {
-						fmt.Println("\nError writing pending data to file:", err)
-						return
-					}
-					totalBytes += len(nextData)
-					delete(pendingPackets, expectedSeqNum)
-					expectedSeqNum++
-				} else {
-					break
-				}
-			}
+			xfer.send(udp.MsgAck, receiver.Next(), receiver.SackBitmap())
 
-			sendACK(conn, seqNum)
-		} else if seqNum > expectedSeqNum {
-			if _, exists := pendingPackets[seqNum]; !exists {
-				pendingPackets[seqNum] = packetData
+		case udp.MsgClose:
+			// Сервер закрывает сессию только после подтверждения всех чанков
+			if !receiver.Complete(h.Seq) || existingSize+receiver.Written() != int64(fileSize) {
+				xfer.send(udp.MsgAck, receiver.Next(), receiver.SackBitmap())
+				continue
 			}
-			sendACK(conn, expectedSeqNum-1)
-		} else {
-			sendACK(conn, seqNum)
-		}
-	}
+			if expected, err := transfer.ParseDigest(string(packetData)); err != nil || expected != receiver.Digest() {
+				xfer.send(udp.MsgCloseAck, receiver.Next(), []byte(transfer.DigestMismatch+" "+receiver.Digest()))
+				fmt.Printf("\nDOWNLOAD FAILED: '%s' does not match the server's SHA-256, data kept in %s (delete it to download from scratch)\n",
+					filename, tempFilename)
+				return
+			}
+			xfer.send(udp.MsgCloseAck, receiver.Next(), []byte(fmt.Sprintf("%s, received %d bytes", transfer.DigestOK, receiver.Written())))
+			closed = true
 
-	if err := bufWriter.Flush(); err != nil {
-		fmt.Println("\nError flushing buffer:", err)
-		return
+		case udp.MsgError:
+			fmt.Println("\nServer aborted download:", string(packetData))
+			return
+		}
 	}
 
 	if err := os.Rename(tempFilename, filename); err != nil {
@@ -529,16 +476,7 @@ func downloadFileUDP(conn *net.UDPConn, filename string) {
 	}
 
 	elapsed := time.Since(start).Seconds()
-	speed := float64(totalBytes-int(existingSize)) / (1024 * 1024 * elapsed)
-	fmt.Printf("\nFile '%s' downloaded successfully (%d bytes in %.2f seconds, %.2f MB/s)\n",
-		filename, totalBytes-int(existingSize), elapsed, speed)
-}
-
-func sendACK(conn *net.UDPConn, seqNum uint32) {
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, seqNum)
-	_, err := conn.Write(buf)
-	if err != nil {
-		fmt.Printf("\nError sending ACK for packet %d: %v\n", seqNum, err)
-	}
+	speed := float64(receiver.Written()) / (1024 * 1024 * elapsed)
+	fmt.Printf("\nFile '%s' downloaded successfully, SHA-256 verified (%d bytes in %.2f seconds, %.2f MB/s, %d corrupt datagrams dropped)\n",
+		filename, receiver.Written(), elapsed, speed, xfer.corrupt)
 }
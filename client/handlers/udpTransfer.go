@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"common/udp"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+const (
+	OpenRetries  = 10
+	CloseRetries = 10
+	IdleTimeout  = 30 * time.Second // Transfer is abandoned after this long without a datagram from the server
+)
+
+// udpTransfer is the client end of one upload or download session
+type udpTransfer struct {
+	conn    *net.UDPConn
+	session uint32
+	buffer  []byte
+	rtt     *udp.RttEstimator
+	corrupt int // Datagrams dropped for a bad checksum
+
+	cipher *udp.Cipher // Set when PreSharedKey is loaded
+	salt   []byte      // Sent in clear in front of the sealed MsgOpen
+}
+
+// openTransfer performs the open handshake and returns the server's reply.
+// A MsgError reply is returned as an error with the server's message.
+func openTransfer(conn *net.UDPConn, request string) (*udpTransfer, string, error) {
+	t := &udpTransfer{
+		conn:   conn,
+		buffer: make([]byte, MaxResponseSize),
+		rtt:    udp.NewRttEstimator(Timeout),
+	}
+	token := rand.Uint32()
+
+	if udp.PreSharedKey != nil {
+		t.salt = make([]byte, udp.SaltSize)
+		crand.Read(t.salt)
+		cipher, err := udp.NewCipher(udp.PreSharedKey, t.salt, false)
+		if err != nil {
+			return nil, "", err
+		}
+		t.cipher = cipher
+	}
+
+	for attempt := 0; attempt < OpenRetries; attempt++ {
+		if err := t.send(udp.MsgOpen, token, []byte(request)); err != nil {
+			return nil, "", err
+		}
+		sent := time.Now()
+
+		deadline := time.Now().Add(t.rtt.Timeout())
+		for {
+			h, payload, err := t.readUntil(deadline)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, "", err
+			}
+
+			// Ответ на чужой или старый MsgOpen пропускаем
+			if h.Seq != token {
+				continue
+			}
+			switch h.Type {
+			case udp.MsgOpenAck:
+				// Ответ на первую попытку дает начальный замер RTT
+				if attempt == 0 {
+					t.rtt.Sample(time.Since(sent))
+				}
+				t.session = h.Session
+				return t, string(payload), nil
+			case udp.MsgError:
+				return nil, "", errors.New(string(payload))
+			}
+		}
+		t.rtt.Expired()
+		fmt.Println("Server not responding, retrying...")
+	}
+
+	return nil, "", errors.New("server did not answer the open request")
+}
+
+func (t *udpTransfer) send(msgType uint8, seq uint32, payload []byte) error {
+	var datagram []byte
+	switch {
+	case t.cipher == nil:
+		datagram = udp.EncodeDatagram(msgType, t.session, seq, payload)
+	case msgType == udp.MsgOpen:
+		datagram = t.cipher.Seal(msgType, t.session, seq, t.salt, payload)
+	default:
+		datagram = t.cipher.Seal(msgType, t.session, seq, nil, payload)
+	}
+
+	_, err := t.conn.Write(datagram)
+	return err
+}
+
+// read returns the next datagram of this session, stale datagrams and text replies are skipped
+func (t *udpTransfer) read(timeout time.Duration) (udp.Header, []byte, error) {
+	return t.readUntil(time.Now().Add(timeout))
+}
+
+func (t *udpTransfer) readUntil(deadline time.Time) (udp.Header, []byte, error) {
+	t.conn.SetReadDeadline(deadline)
+	defer t.conn.SetReadDeadline(time.Time{})
+
+	for {
+		n, _, err := t.conn.ReadFromUDP(t.buffer)
+		if err != nil {
+			return udp.Header{}, nil, err
+		}
+
+		h, payload, err := udp.DecodeDatagram(t.buffer[:n])
+		if err == udp.ErrBadChecksum {
+			// Испорченный чанк будет запрошен заново, как потерянный
+			t.corrupt++
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if t.session != 0 && h.Session != t.session {
+			continue
+		}
+		if payload, err = t.unseal(h, payload); err != nil {
+			continue
+		}
+		return h, payload, nil
+	}
+}
+
+// unseal decrypts a datagram of an encrypted transfer. Until the server
+// accepts the open request a plaintext MsgError is let through, the server
+// sends one when it does not share our mode or our key.
+func (t *udpTransfer) unseal(h udp.Header, payload []byte) ([]byte, error) {
+	if t.cipher == nil {
+		if h.Sealed {
+			return nil, udp.ErrBadSeal
+		}
+		return payload, nil
+	}
+	if !h.Sealed && h.Type == udp.MsgError && t.session == 0 {
+		return payload, nil
+	}
+
+	// Перед MsgOpenAck и MsgError сервер присылает свою соль
+	if h.Sealed && (h.Type == udp.MsgOpenAck || h.Type == udp.MsgError) {
+		if len(payload) < udp.SaltSize {
+			return nil, udp.ErrBadSeal
+		}
+		if !t.cipher.Started() {
+			return t.cipher.OpenFirst(h, payload[:udp.SaltSize], payload[udp.SaltSize:])
+		}
+		payload = payload[udp.SaltSize:]
+	}
+	return t.cipher.Open(h, payload)
+}
+
+// runCommand sends a text command in a session of its own, a server with
+// -psk-file takes no plaintext commands. A lost reply is asked for again
+// with the same seq, the server does not run the command twice.
+func runCommand(conn *net.UDPConn, command string) (string, error) {
+	t, _, err := openTransfer(conn, udp.CommandSession)
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < CloseRetries; attempt++ {
+		if err := t.send(udp.MsgCommand, 1, []byte(command)); err != nil {
+			return "", err
+		}
+
+		deadline := time.Now().Add(t.rtt.Timeout())
+		for {
+			h, payload, err := t.readUntil(deadline)
+			if err != nil {
+				if isTimeout(err) {
+					t.rtt.Expired()
+					break
+				}
+				return "", err
+			}
+			switch h.Type {
+			case udp.MsgReply:
+				return string(payload), nil
+			case udp.MsgError:
+				return "", errors.New(string(payload))
+			}
+		}
+	}
+	return "", errors.New("server did not answer the command")
+}
+
+// closeTransfer sends MsgClose until the server confirms it and returns the server's final status
+func (t *udpTransfer) closeTransfer(numChunks uint32, digest string) (string, error) {
+	for attempt := 0; attempt < CloseRetries; attempt++ {
+		if err := t.send(udp.MsgClose, numChunks, []byte(digest)); err != nil {
+			return "", err
+		}
+
+		deadline := time.Now().Add(t.rtt.Timeout())
+		for {
+			h, payload, err := t.readUntil(deadline)
+			if err != nil {
+				if isTimeout(err) {
+					t.rtt.Expired()
+					break
+				}
+				return "", err
+			}
+			switch h.Type {
+			case udp.MsgCloseAck:
+				return string(payload), nil
+			case udp.MsgError:
+				return "", errors.New(string(payload))
+			}
+		}
+	}
+	return "", errors.New("server did not confirm the end of transfer")
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"bufio"
 	"client/handlers"
+	"common/udp"
+	"flag"
 	"fmt"
+	"log"
 	"os"
 )
 
@@ -12,9 +15,40 @@ const (
 	udpAddr = "127.0.0.1:9091"
 )
 
+var (
+	useTLS        = flag.Bool("tls", false, "connect over TLS, trusting the system CAs unless -tls-ca is given")
+	tlsCA         = flag.String("tls-ca", "", "PEM CA bundle to trust for the server certificate, implies -tls")
+	tlsCert       = flag.String("tls-cert", "", "PEM client certificate for servers that require one, implies -tls")
+	tlsKey        = flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsServerName = flag.String("tls-server-name", "", "name to verify in the server certificate instead of the dialed host")
+	login         = flag.Bool("login", false, "log in to servers started with -users, credentials come from "+handlers.UserEnv+" and "+handlers.PasswordEnv+" or are asked for")
+	pskFile       = flag.String("psk-file", "", "file with the server's pre-shared key, encrypts UDP transfers")
+)
+
 func main() {
+	flag.IntVar(&udp.MaxWindow, "max-window", udp.MaxWindow, "largest UDP congestion window in chunks")
+	flag.Parse()
+
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		if err := handlers.SetupTLS(*tlsCA, *tlsCert, *tlsKey, *tlsServerName); err != nil {
+			log.Fatalf("TLS error: %v", err)
+		}
+	}
+
+	if *pskFile != "" {
+		if err := udp.LoadPreSharedKey(*pskFile); err != nil {
+			log.Fatalf("Key error: %v", err)
+		}
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
 
+	if *login || handlers.LoginFromEnv() {
+		if err := handlers.SetupLogin(scanner); err != nil {
+			log.Fatalf("Login error: %v", err)
+		}
+	}
+
 	for {
 		fmt.Println("\nChoose protocol: 1 - TCP, 2 - UDP, 3 - Exit")
 		if !scanner.Scan() {
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Accounts are read from the file given with -users, one per line:
+//
+//	name:pbkdf2-sha256:iterations:salt:hash:role:quota
+//
+// salt and hash are base64, role is one of the Role* constants and guest
+// when omitted. quota is a size like 500M, 0 for unlimited, and
+// DefaultUserQuota when omitted. Lines starting with # are comments. With the file loaded
+// every client has to LOGIN before any other command and is then confined
+// to the root of its role, see accountRoot.
+const (
+	HashScheme     = "pbkdf2-sha256"
+	HashIterations = 600000
+	HashSize       = 32
+	LoginFailDelay = time.Second // Slows down password guessing
+)
+
+// Roles limit the commands of an account, anonymous clients of a server
+// without -users act as RoleAdmin
+const (
+	RoleGuest  = "guest"  // Reads files: ECHO, TIME, DOWNLOAD
+	RoleIngest = "ingest" // Only delivers files with UPLOAD
+	RoleAdmin  = "admin"  // Every command
+)
+
+var rolePermissions = map[string]map[string]bool{
+	RoleGuest:  {"ECHO": true, "TIME": true, "DOWNLOAD": true},
+	RoleIngest: {"UPLOAD": true},
+}
+
+var (
+	ErrLoginFailed      = errors.New("invalid user name or password")
+	ErrLoginRequired    = errors.New("login required, send LOGIN <user> <password>")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrUnknownRole      = errors.New("role must be guest, ingest or admin")
+	ErrBadUserName      = errors.New("user names may contain only letters, digits, '.', '_' and '-' and must not start with '.'")
+)
+
+// PublicDir under Root holds the homes of ingest accounts, guests
+// download what they delivered from there
+const PublicDir = "public"
+
+// Users holds the accounts from -users, nil when clients are anonymous
+var Users map[string]*userRecord
+
+type userRecord struct {
+	name       string
+	iterations int
+	salt       []byte
+	hash       []byte
+	role       string
+	quota      int64 // -1 when the line sets none
+}
+
+// Account is the identity of a client session and the root its file names resolve in
+type Account struct {
+	name  string
+	role  string
+	root  string
+	quota int64 // Bytes allowed under root, 0 for unlimited
+}
+
+func (a *Account) Name() string { return a.name }
+
+// Root is the directory the file names of the account resolve in
+func (a *Account) Root() string { return a.root }
+
+func LoadUsers(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("could not read users file: %v", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]*userRecord)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, err := parseUserLine(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, lineNo, err)
+		}
+		if users[user.name] != nil {
+			return fmt.Errorf("%s:%d: duplicate user %s", file, lineNo, user.name)
+		}
+		users[user.name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	Users = users
+	return nil
+}
+
+func parseUserLine(line string) (*userRecord, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) == 5 {
+		fields = append(fields, RoleGuest)
+	}
+	if len(fields) == 6 {
+		fields = append(fields, "")
+	}
+	if len(fields) != 7 {
+		return nil, errors.New("expected name:scheme:iterations:salt:hash:role:quota")
+	}
+	if !validRole(fields[5]) {
+		return nil, ErrUnknownRole
+	}
+	if !validUserName(fields[0]) {
+		return nil, ErrBadUserName
+	}
+	if fields[1] != HashScheme {
+		return nil, fmt.Errorf("unsupported hash scheme %q", fields[1])
+	}
+
+	iterations, err := strconv.Atoi(fields[2])
+	if err != nil || iterations < 1 {
+		return nil, errors.New("invalid iteration count")
+	}
+	salt, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return nil, errors.New("invalid salt")
+	}
+	hash, err := base64.StdEncoding.DecodeString(fields[4])
+	if err != nil || len(hash) == 0 {
+		return nil, errors.New("invalid hash")
+	}
+
+	quota := int64(-1)
+	if fields[6] != "" {
+		if quota, err = parseSize(fields[6]); err != nil {
+			return nil, fmt.Errorf("invalid quota: %v", err)
+		}
+	}
+
+	return &userRecord{name: fields[0], iterations: iterations, salt: salt, hash: hash, role: fields[5], quota: quota}, nil
+}
+
+// AddUser appends an account with a freshly salted password hash to file
+func AddUser(file, name, role, password string) error {
+	if !validUserName(name) {
+		return ErrBadUserName
+	}
+	if !validRole(role) {
+		return ErrUnknownRole
+	}
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	// Существующий файл должен разбираться, иначе дубликат не заметить
+	if _, err := os.Stat(file); err == nil {
+		if err := LoadUsers(file); err != nil {
+			return err
+		}
+		if Users[name] != nil {
+			return fmt.Errorf("user %s already exists", name)
+		}
+	}
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	hash, err := pbkdf2.Key(sha256.New, password, salt, HashIterations, HashSize)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s:%s:%d:%s:%s:%s\n", name, HashScheme, HashIterations,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(hash), role)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func validUserName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func validRole(role string) bool {
+	return role == RoleGuest || role == RoleIngest || role == RoleAdmin
+}
+
+// AnonymousAccount is the account a new session starts with, nil when it has to LOGIN first
+func AnonymousAccount() *Account {
+	if Users != nil {
+		return nil
+	}
+	return &Account{role: RoleAdmin, root: Root}
+}
+
+// Login checks the password and prepares the user's home directory
+func Login(name, password string) (*Account, error) {
+	user := Users[name]
+	if user == nil {
+		// Хешируем и для несуществующего имени, чтобы время ответа его не выдавало
+		pbkdf2.Key(sha256.New, password, []byte(name), HashIterations, HashSize)
+		time.Sleep(LoginFailDelay)
+		return nil, ErrLoginFailed
+	}
+
+	hash, err := pbkdf2.Key(sha256.New, password, user.salt, user.iterations, len(user.hash))
+	if err != nil || subtle.ConstantTimeCompare(hash, user.hash) != 1 {
+		time.Sleep(LoginFailDelay)
+		return nil, ErrLoginFailed
+	}
+
+	home := accountRoot(name, user.role)
+	if err := os.MkdirAll(home, 0755); err != nil {
+		return nil, fmt.Errorf("could not create home directory: %v", ClientError(err))
+	}
+	// Корень сессии, как и Root, храним без символических ссылок
+	root, err := filepath.EvalSymlinks(home)
+	if err != nil {
+		return nil, ClientError(err)
+	}
+	quota := DefaultUserQuota
+	if user.quota >= 0 {
+		quota = user.quota
+	}
+	return &Account{name: name, role: user.role, root: root, quota: quota}, nil
+}
+
+// accountRoot is the directory file names of an account resolve in: admins
+// see the whole store, ingest accounts write to their home PublicDir/<name>
+// and guests read all of PublicDir
+func accountRoot(name, role string) string {
+	switch role {
+	case RoleAdmin:
+		return Root
+	case RoleGuest:
+		return filepath.Join(Root, PublicDir)
+	default:
+		return filepath.Join(Root, PublicDir, name)
+	}
+}
+
+// Authorize is checked before every command is dispatched. LOGIN is always
+// allowed, anything else needs an account whose role permits the command.
+func Authorize(acc *Account, cmd string) error {
+	switch {
+	case cmd == "LOGIN":
+		return nil
+	case acc == nil:
+		return ErrLoginRequired
+	case acc.role == RoleAdmin || rolePermissions[acc.role][cmd]:
+		return nil
+	default:
+		return ErrPermissionDenied
+	}
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// userLine builds a users file line with a cheap hash, rest is appended after the hash field
+func userLine(t *testing.T, name, password, rest string) string {
+	t.Helper()
+	salt := []byte("salt-" + name)
+	hash, err := pbkdf2.Key(sha256.New, password, salt, 1, HashSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := fmt.Sprintf("%s:%s:1:%s:%s", name, HashScheme,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(hash))
+	if rest != "" {
+		line += ":" + rest
+	}
+	return line
+}
+
+// withUsers points Root at a fresh root and loads a users file made of lines
+func withUsers(t *testing.T, lines ...string) string {
+	t.Helper()
+	root, oldRoot, oldUsers, oldQuota := newTestRoot(t), Root, Users, DefaultUserQuota
+	Root = root
+	t.Cleanup(func() { Root, Users, DefaultUserQuota = oldRoot, oldUsers, oldQuota })
+
+	file := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadUsers(file); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestParseUserLine(t *testing.T) {
+	valid := userLine(t, "carol", "pw", "")
+	tests := []struct {
+		name  string
+		line  string
+		role  string
+		quota int64
+		ok    bool
+	}{
+		{"no role", valid, RoleGuest, -1, true},
+		{"admin", valid + ":admin", RoleAdmin, -1, true},
+		{"ingest with quota", valid + ":ingest:500M", RoleIngest, 500 << 20, true},
+		{"empty quota", valid + ":guest:", RoleGuest, -1, true},
+		{"unlimited quota", valid + ":guest:0", RoleGuest, 0, true},
+		{"too few fields", "carol:" + HashScheme + ":1:c2FsdA==", "", 0, false},
+		{"too many fields", valid + ":guest:1G:extra", "", 0, false},
+		{"unknown role", valid + ":root", "", 0, false},
+		{"empty role", valid + ":", "", 0, false},
+		{"bad quota", valid + ":guest:lots", "", 0, false},
+		{"dot name", strings.Replace(valid, "carol", ".carol", 1), "", 0, false},
+		{"empty name", strings.Replace(valid, "carol", "", 1), "", 0, false},
+		{"bad scheme", strings.Replace(valid, HashScheme, "md5", 1), "", 0, false},
+		{"zero iterations", strings.Replace(valid, ":1:", ":0:", 1), "", 0, false},
+		{"bad salt", strings.Replace(valid, ":1:", ":1:!", 1), "", 0, false},
+		{"empty hash", valid[:strings.LastIndex(valid, ":")+1], "", 0, false},
+	}
+	for _, tt := range tests {
+		user, err := parseUserLine(tt.line)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: parseUserLine(%q) = %v, want ok %v", tt.name, tt.line, err, tt.ok)
+			continue
+		}
+		if tt.ok && (user.role != tt.role || user.quota != tt.quota) {
+			t.Errorf("%s: role %q quota %d, want %q %d", tt.name, user.role, user.quota, tt.role, tt.quota)
+		}
+	}
+
+	if _, err := parseUserLine(valid + ":root"); !errors.Is(err, ErrUnknownRole) {
+		t.Errorf("unknown role = %v, want %v", err, ErrUnknownRole)
+	}
+	if _, err := parseUserLine("a/b" + valid[len("carol"):]); !errors.Is(err, ErrBadUserName) {
+		t.Errorf("name with a slash = %v, want %v", err, ErrBadUserName)
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	withUsers(t, "# accounts", "", userLine(t, "carol", "pw", "admin"), userLine(t, "gus", "pw", ""))
+	if len(Users) != 2 || Users["carol"].role != RoleAdmin || Users["gus"].role != RoleGuest {
+		t.Errorf("LoadUsers = %v", Users)
+	}
+
+	file := filepath.Join(t.TempDir(), "users")
+	duplicate := userLine(t, "carol", "pw", "admin") + "\n" + userLine(t, "carol", "other", "guest") + "\n"
+	if err := os.WriteFile(file, []byte(duplicate), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadUsers(file); err == nil || !strings.Contains(err.Error(), "duplicate user carol") {
+		t.Errorf("LoadUsers with a duplicate = %v", err)
+	}
+	if len(Users) != 2 {
+		t.Error("failed LoadUsers replaced the loaded accounts")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	commands := []string{"LOGIN", "ECHO", "TIME", "DOWNLOAD", "UPLOAD", "LIST", "STAT", "DELETE", "RENAME", "MKDIR"}
+	allowed := map[string]string{
+		RoleGuest:  "LOGIN ECHO TIME DOWNLOAD",
+		RoleIngest: "LOGIN UPLOAD",
+		RoleAdmin:  strings.Join(commands, " "),
+	}
+	for role, list := range allowed {
+		acc := &Account{name: "u", role: role}
+		for _, cmd := range commands {
+			want := ErrPermissionDenied
+			if strings.Contains(" "+list+" ", " "+cmd+" ") {
+				want = nil
+			}
+			if err := Authorize(acc, cmd); err != want {
+				t.Errorf("Authorize(%s, %s) = %v, want %v", role, cmd, err, want)
+			}
+		}
+	}
+
+	// Без входа доступен только LOGIN
+	for _, cmd := range commands {
+		want := ErrLoginRequired
+		if cmd == "LOGIN" {
+			want = nil
+		}
+		if err := Authorize(nil, cmd); err != want {
+			t.Errorf("Authorize(nil, %s) = %v, want %v", cmd, err, want)
+		}
+	}
+}
+
+func TestAccountRoot(t *testing.T) {
+	oldRoot := Root
+	Root = "/srv/files"
+	t.Cleanup(func() { Root = oldRoot })
+
+	tests := []struct {
+		role string
+		want string
+	}{
+		{RoleAdmin, "/srv/files"},
+		{RoleGuest, "/srv/files/public"},
+		{RoleIngest, "/srv/files/public/ing"},
+	}
+	for _, tt := range tests {
+		if got := accountRoot("ing", tt.role); got != tt.want {
+			t.Errorf("accountRoot(ing, %s) = %q, want %q", tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestAnonymousAccount(t *testing.T) {
+	oldUsers := Users
+	t.Cleanup(func() { Users = oldUsers })
+
+	Users = nil
+	if acc := AnonymousAccount(); acc == nil || acc.role != RoleAdmin || acc.root != Root {
+		t.Errorf("AnonymousAccount without users = %+v, want an admin at Root", acc)
+	}
+	Users = map[string]*userRecord{}
+	if acc := AnonymousAccount(); acc != nil {
+		t.Errorf("AnonymousAccount with users = %+v, want nil", acc)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	root := withUsers(t,
+		userLine(t, "carol", "secret", "admin"),
+		userLine(t, "ing", "pw1", "ingest:1M"),
+		userLine(t, "gus", "pw2", ""))
+	DefaultUserQuota = 100
+
+	tests := []struct {
+		name, password string
+		root           string
+		quota          int64
+	}{
+		{"carol", "secret", root, 100},
+		{"ing", "pw1", filepath.Join(root, PublicDir, "ing"), 1 << 20},
+		{"gus", "pw2", filepath.Join(root, PublicDir), 100},
+	}
+	for _, tt := range tests {
+		acc, err := Login(tt.name, tt.password)
+		if err != nil {
+			t.Errorf("Login(%s) = %v", tt.name, err)
+			continue
+		}
+		if acc.Name() != tt.name || acc.Root() != tt.root || acc.quota != tt.quota {
+			t.Errorf("Login(%s) = %+v, want root %q quota %d", tt.name, acc, tt.root, tt.quota)
+		}
+		// Домашний каталог создается при входе
+		if info, err := os.Stat(acc.Root()); err != nil || !info.IsDir() {
+			t.Errorf("home of %s was not created: %v", tt.name, err)
+		}
+	}
+
+	if testing.Short() {
+		t.Skip("failed logins wait LoginFailDelay")
+	}
+	if _, err := Login("carol", "pw1"); !errors.Is(err, ErrLoginFailed) {
+		t.Errorf("Login with a wrong password = %v, want %v", err, ErrLoginFailed)
+	}
+	if _, err := Login("mallory", "secret"); !errors.Is(err, ErrLoginFailed) {
+		t.Errorf("Login of an unknown user = %v, want %v", err, ErrLoginFailed)
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrStorageRoot = errors.New("operation is not allowed on the storage root")
+
+// formatEntry renders one line of LIST/STAT output: type, size, mtime and name
+func formatEntry(info os.FileInfo, name string) string {
+	kind := "f"
+	switch {
+	case info.IsDir():
+		kind = "d"
+	case info.Mode()&os.ModeSymlink != 0:
+		kind = "l"
+	}
+	return fmt.Sprintf("%s %12d %s %s", kind, info.Size(), info.ModTime().UTC().Format(time.RFC3339), name)
+}
+
+func List(root, dir string) ([]string, error) {
+	if dir == "" {
+		dir = "."
+	}
+
+	path, err := ResolvePath(root, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, ClientError(err)
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == StagingDir {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Файл мог исчезнуть между чтением каталога и stat
+			continue
+		}
+		lines = append(lines, formatEntry(info, entry.Name()))
+	}
+	return lines, nil
+}
+
+func Stat(root, name string) (string, error) {
+	path, err := ResolveEntry(root, name)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", ClientError(err)
+	}
+	return formatEntry(info, name), nil
+}
+
+// Delete removes a file or an empty directory
+func Delete(root, name string) error {
+	path, err := ResolveEntry(root, name)
+	if err != nil {
+		return err
+	}
+	if path == root {
+		return ErrStorageRoot
+	}
+	return ClientError(os.Remove(path))
+}
+
+func Rename(root, from, to string) error {
+	fromPath, err := ResolveEntry(root, from)
+	if err != nil {
+		return err
+	}
+	toPath, err := ResolveEntry(root, to)
+	if err != nil {
+		return err
+	}
+	if fromPath == root || toPath == root {
+		return ErrStorageRoot
+	}
+	return ClientError(os.Rename(fromPath, toPath))
+}
+
+func MakeDir(root, name string) error {
+	path, err := ResolvePath(root, name)
+	if err != nil {
+		return err
+	}
+	return ClientError(os.MkdirAll(path, 0755))
+}
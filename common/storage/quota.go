@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Limits on stored data, 0 means unlimited. MaxFileSize caps one upload,
+// GlobalQuota the files under Root and the per-user quota the files
+// under the root of the account, partial uploads included, for an admin
+// that is all of Root. DefaultUserQuota applies to accounts whose
+// line in the users file sets no quota of its own.
+var (
+	MaxFileSize      int64
+	GlobalQuota      int64
+	DefaultUserQuota int64
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrFileTooLarge  = errors.New("file exceeds the maximum file size")
+	ErrBadSize       = errors.New("size must be a number of bytes with an optional K, M, G or T suffix")
+)
+
+// QuotaLedger in the staging directory of Root lists the uploads in
+// flight of every child process, one "pid size partPath" line each. Children
+// rewrite it under an exclusive flock, lines of dead processes are dropped.
+const QuotaLedger = "quota.ledger"
+
+// UploadQuota is how large an upload may grow and the error reported when it grows beyond that
+type UploadQuota struct {
+	limit       int64 // -1 when unlimited
+	err         error
+	reservation *reservation // Room held for the upload while a quota applies
+}
+
+// reservation holds room for an upload in flight. The bytes its partial
+// file has yet to grow by count as used for every other upload under the
+// same root, so parallel uploads are not promised the same free space.
+type reservation struct {
+	pid      int
+	size     int64 // Final size of the partial file
+	partPath string
+}
+
+// NewUploadQuota computes the room left for the upload of size bytes, -1
+// when unknown, that ends up at path, and reserves it until release. The
+// existing file and the partial upload are replaced by it, so their bytes
+// count as free.
+func NewUploadQuota(acc *Account, path, partPath string, size int64) (UploadQuota, error) {
+	q := UploadQuota{limit: -1}
+	if MaxFileSize > 0 {
+		q = UploadQuota{limit: MaxFileSize, err: ErrFileTooLarge}
+	}
+	if GlobalQuota <= 0 && acc.quota <= 0 {
+		return q, q.Check(size)
+	}
+
+	// Каждый клиент обслуживает отдельный процесс, поэтому подсчет и
+	// резервирование идут под блокировкой файла, а не мьютекса
+	ledger, active, err := lockLedger()
+	if err != nil {
+		return q, err
+	}
+	defer ledger.Close()
+
+	replaced := regularSize(path) + regularSize(partPath)
+	for _, quota := range []struct {
+		root  string
+		bytes int64
+	}{{Root, GlobalQuota}, {acc.root, acc.quota}} {
+		if quota.bytes <= 0 {
+			continue
+		}
+		used, err := diskUsage(quota.root)
+		if err != nil {
+			return q, ClientError(err)
+		}
+		if free := max(quota.bytes-used-pendingBytes(active, quota.root)+replaced, 0); q.limit < 0 || free < q.limit {
+			q = UploadQuota{limit: free, err: ErrQuotaExceeded}
+		}
+	}
+	if err := q.Check(size); err != nil {
+		return q, err
+	}
+
+	// Загрузка без объявленного размера может занять весь остаток
+	if size < 0 {
+		size = q.limit
+	}
+	r := &reservation{pid: os.Getpid(), size: size, partPath: partPath}
+	if err := writeLedger(ledger, append(active, r)); err != nil {
+		return q, err
+	}
+	q.reservation = r
+	return q, nil
+}
+
+// Release frees the reserved room once the upload is committed or aborted
+func (q UploadQuota) Release() {
+	if q.reservation == nil {
+		return
+	}
+	ledger, active, err := lockLedger()
+	if err != nil {
+		fmt.Printf("Could not release quota reservation: %v\n", err)
+		return
+	}
+	defer ledger.Close()
+
+	for i, r := range active {
+		if *r == *q.reservation {
+			active = append(active[:i], active[i+1:]...)
+			break
+		}
+	}
+	if err := writeLedger(ledger, active); err != nil {
+		fmt.Printf("Could not release quota reservation: %v\n", err)
+	}
+}
+
+// lockLedger opens QuotaLedger with an exclusive lock and reads the
+// reservations of live processes, closing the file releases the lock
+func lockLedger() (*os.File, []*reservation, error) {
+	if err := os.MkdirAll(filepath.Join(Root, StagingDir), 0700); err != nil {
+		return nil, nil, ClientError(err)
+	}
+	f, err := os.OpenFile(ledgerPath(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, ClientError(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	var active []*reservation
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(fields[0])
+		size, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil || !processAlive(pid) {
+			continue
+		}
+		active = append(active, &reservation{pid: pid, size: size, partPath: fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, active, nil
+}
+
+func ledgerPath() string {
+	return filepath.Join(Root, StagingDir, QuotaLedger)
+}
+
+func writeLedger(f *os.File, active []*reservation) error {
+	var b strings.Builder
+	for _, r := range active {
+		fmt.Fprintf(&b, "%d %d %s\n", r.pid, r.size, r.partPath)
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(b.String()), 0)
+	return err
+}
+
+// processAlive reports whether pid still runs, a child killed mid-upload leaves its line behind
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// pendingBytes is the room reserved under root and not written yet
+func pendingBytes(active []*reservation, root string) int64 {
+	var total int64
+	for _, r := range active {
+		// Записанная часть уже учтена в diskUsage
+		if isWithin(root, r.partPath) {
+			total += max(r.size-regularSize(r.partPath), 0)
+		}
+	}
+	return total
+}
+
+// Check fails when a file of size bytes does not fit, a negative size is not known yet
+func (q UploadQuota) Check(size int64) error {
+	if q.limit >= 0 && size > q.limit {
+		return q.err
+	}
+	return nil
+}
+
+// Writer limits w to the quota, offset is the size of the file before the first write
+func (q UploadQuota) Writer(w io.Writer, offset int64) io.Writer {
+	return &quotaWriter{w: w, quota: q, written: offset}
+}
+
+// quotaWriter stops an upload once the file would outgrow its quota, written starts at the resume offset
+type quotaWriter struct {
+	w       io.Writer
+	quota   UploadQuota
+	written int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if err := w.quota.Check(w.written + int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func IsQuotaError(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrFileTooLarge)
+}
+
+// diskUsage sums the sizes of the regular files under root
+func diskUsage(root string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Файлы, удаленные во время обхода, просто не считаем
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		// Сам журнал резервов хранимым файлом не является
+		if entry.Type().IsRegular() && path != ledgerPath() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+func regularSize(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// parseSize reads sizes like 1048576, 512K or 10G
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		multiplier = 1 << (10 * (strings.IndexByte("KMGT", s[i]) + 1))
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/multiplier {
+		return 0, ErrBadSize
+	}
+	return n * multiplier, nil
+}
+
+type sizeValue struct{ p *int64 }
+
+// SizeValue lets a size flag accept the suffixes of parseSize
+func SizeValue(p *int64) flag.Value {
+	return sizeValue{p}
+}
+
+func (v sizeValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*v.p, 10)
+}
+
+func (v sizeValue) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v.p = n
+	return nil
+}
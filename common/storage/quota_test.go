@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// withQuota points Root at a fresh root with a global quota of limit bytes
+func withQuota(t *testing.T, limit int64) *Account {
+	t.Helper()
+	root, oldRoot, oldQuota := newTestRoot(t), Root, GlobalQuota
+	Root, GlobalQuota = root, limit
+	t.Cleanup(func() { Root, GlobalQuota = oldRoot, oldQuota })
+	return &Account{role: RoleAdmin, root: root}
+}
+
+func TestUploadQuotaReservesRoom(t *testing.T) {
+	acc := withQuota(t, 100)
+	path := func(name string) (string, string) {
+		p := filepath.Join(acc.root, name)
+		return p, StagingPath(acc.root, p)
+	}
+
+	a, aPart := path("a.bin")
+	first, err := NewUploadQuota(acc, a, aPart, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Параллельная загрузка не получает место, обещанное первой
+	b, bPart := path("b.bin")
+	if _, err := NewUploadQuota(acc, b, bPart, 60); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("second upload of 60 bytes = %v, want %v", err, ErrQuotaExceeded)
+	}
+	second, err := NewUploadQuota(acc, b, bPart, 40)
+	if err != nil {
+		t.Fatalf("second upload of 40 bytes: %v", err)
+	}
+	second.Release()
+
+	// Записанные байты учтены на диске и не считаются дважды
+	if err := os.MkdirAll(filepath.Dir(aPart), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(aPart, make([]byte, 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewUploadQuota(acc, b, bPart, 41); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("upload of 41 bytes beside a half written one = %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	first.Release()
+	os.Remove(aPart)
+	third, err := NewUploadQuota(acc, b, bPart, 100)
+	if err != nil {
+		t.Fatalf("upload after release: %v", err)
+	}
+	third.Release()
+}
+
+func TestUploadQuotaUnknownSize(t *testing.T) {
+	acc := withQuota(t, 100)
+	p := filepath.Join(acc.root, "stream.bin")
+	q, err := NewUploadQuota(acc, p, StagingPath(acc.root, p), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Release()
+
+	// Без объявленного размера резервируется весь остаток квоты
+	other := filepath.Join(acc.root, "other.bin")
+	if _, err := NewUploadQuota(acc, other, StagingPath(acc.root, other), 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("upload beside one of unknown size = %v, want %v", err, ErrQuotaExceeded)
+	}
+}
+
+func TestUploadQuotaDropsDeadChildren(t *testing.T) {
+	acc := withQuota(t, 100)
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Skip("no true command:", err)
+	}
+
+	// Ребенок, убитый посреди загрузки, не держит место вечно
+	if err := os.MkdirAll(filepath.Join(acc.root, StagingDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	line := fmt.Sprintf("%d 100 %s\n", dead.Process.Pid, filepath.Join(acc.root, StagingDir, "x.part"))
+	if err := os.WriteFile(ledgerPath(), []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(acc.root, "file.bin")
+	q, err := NewUploadQuota(acc, p, StagingPath(acc.root, p), 100)
+	if err != nil {
+		t.Fatalf("upload beside a dead child's reservation: %v", err)
+	}
+	q.Release()
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	ErrEmptyPath     = errors.New("empty file name")
+	ErrAbsolutePath  = errors.New("absolute paths are not allowed")
+	ErrPathTraversal = errors.New("'..' is not allowed in file names")
+	ErrSymlinkEscape = errors.New("symlink leads outside of the storage root")
+
+	// ErrUploadInProgress means another connection holds the partial file
+	ErrUploadInProgress = errors.New("upload already in progress")
+)
+
+// Root is the directory all client supplied file names are confined to
+var Root = "."
+
+func SetRoot(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create storage root: %v", err)
+	}
+
+	absRoot, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	// Храним корень без символических ссылок, чтобы сравнение префиксов было честным
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return err
+	}
+
+	Root = realRoot
+	return nil
+}
+
+// ResolvePath maps a client supplied name to a path inside root.
+// Names must be relative, must not contain ".." and must not pass through
+// a symlink that points outside of root.
+func ResolvePath(root, name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+
+	fullPath := filepath.Join(root, name)
+
+	// Раскрываем ссылки в самой длинной существующей части пути,
+	// несуществующий хвост будет создан внутри уже проверенного каталога
+	existing := fullPath
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = resolved
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		// Висячая ссылка: os.Create пошел бы по ней куда угодно
+		if info, lerr := os.Lstat(existing); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", ErrSymlinkEscape
+		}
+
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+
+	if !isWithin(root, existing) {
+		return "", ErrSymlinkEscape
+	}
+
+	return filepath.Join(existing, rest), nil
+}
+
+// ResolveEntry is like resolvePath but leaves the last element unresolved,
+// so DELETE or RENAME of a symlink affects the link and not its target.
+func ResolveEntry(root, name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+
+	name = filepath.Clean(name)
+	if name == "." {
+		return root, nil
+	}
+
+	dir, err := ResolvePath(root, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(name)), nil
+}
+
+// Uploads are written to a partial file in StagingDir and renamed to their
+// real name only after the transfer completed and verified, so a file never
+// shows up half written. A partial file outlives a dropped connection and
+// the next upload of the same name resumes from its length.
+const (
+	StagingDir    = ".staging"
+	PartialSuffix = ".part"
+)
+
+var ErrReservedName = errors.New("name is reserved by the server")
+
+// StagingPath returns the partial file of the upload that ends up at path
+func StagingPath(root, path string) string {
+	key := sha256.Sum256([]byte(path))
+	return filepath.Join(root, StagingDir, hex.EncodeToString(key[:])+PartialSuffix)
+}
+
+// OpenPartial opens the partial upload of the resolved path, keeping the
+// bytes received by an earlier attempt if they fit into a file of size
+// bytes. The file is positioned at the offset the upload resumes from and
+// stays locked until it is committed or closed.
+func OpenPartial(root, path string, size int64) (*os.File, string, int64, error) {
+	// Каталог назначения проверяем сразу, а не после передачи всего файла
+	if info, err := os.Stat(filepath.Dir(path)); err != nil {
+		return nil, "", 0, ClientError(err)
+	} else if !info.IsDir() {
+		return nil, "", 0, syscall.ENOTDIR
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, StagingDir), 0700); err != nil {
+		return nil, "", 0, ClientError(err)
+	}
+
+	// Права файла переходят к загруженному файлу после переименования,
+	// недописанные файлы закрывает от чужих сам каталог 0700
+	partPath := StagingPath(root, path)
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, "", 0, ClientError(err)
+	}
+
+	// Две загрузки одного файла писали бы в один частичный файл
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, "", 0, ErrUploadInProgress
+		}
+		return nil, "", 0, ClientError(err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, "", 0, ClientError(err)
+	}
+
+	// Без известного размера или с более длинным остатком начинаем заново
+	offset := info.Size()
+	if size < 0 || offset > size {
+		offset = 0
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, "", 0, ClientError(err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, "", 0, ClientError(err)
+	}
+	return file, partPath, offset, nil
+}
+
+// CommitPartial makes a finished upload visible under its real name. The
+// data and the rename are flushed to disk, so after a crash the file is
+// either complete or still in staging. The lock is kept until the rename,
+// so no other upload can open the partial file in between.
+func CommitPartial(file *os.File, partPath, path string) error {
+	defer file.Close()
+	if err := file.Sync(); err != nil {
+		return ClientError(err)
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return ClientError(err)
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return ClientError(err)
+	}
+	defer dir.Close()
+	return ClientError(dir.Sync())
+}
+
+func checkName(name string) error {
+	if name == "" {
+		return ErrEmptyPath
+	}
+
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return ErrAbsolutePath
+	}
+
+	// Каталог с недокачанными файлами есть в корне каждой учетной записи,
+	// а корень администратора включает корни остальных
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		switch part {
+		case "..":
+			return ErrPathTraversal
+		case StagingDir:
+			return ErrReservedName
+		}
+	}
+	return nil
+}
+
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// ClientError strips server side paths from errors that are sent to clients
+func ClientError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return linkErr.Err
+	}
+	return err
+}
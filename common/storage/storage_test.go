@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRoot creates a storage root without symlinks in its own path, like SetRoot does
+func newTestRoot(t *testing.T) string {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"file.bin", nil},
+		{"dir/file.bin", nil},
+		{"./file.bin", nil},
+		{"dir/../file.bin", ErrPathTraversal},
+		{"..", ErrPathTraversal},
+		{"../outside", ErrPathTraversal},
+		{"dir/..", ErrPathTraversal},
+		{"..file", nil},
+		{"", ErrEmptyPath},
+		{"/etc/passwd", ErrAbsolutePath},
+		{StagingDir, ErrReservedName},
+		{StagingDir + "/x.part", ErrReservedName},
+		{"./" + StagingDir + "/x.part", ErrReservedName},
+		{"dir/" + StagingDir, ErrReservedName},
+		{"public/ing/" + StagingDir + "/x.part", ErrReservedName},
+		{"dir/" + StagingDir + "/../file.bin", ErrReservedName},
+	}
+	for _, tt := range tests {
+		if err := checkName(tt.name); !errors.Is(err, tt.want) {
+			t.Errorf("checkName(%q) = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	root := newTestRoot(t)
+	outside := newTestRoot(t)
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"inner":    filepath.Join(root, "dir"),
+		"escape":   outside,
+		"dangling": filepath.Join(outside, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string // Пусто, если имя должно быть отклонено
+		err  error
+	}{
+		{"file.bin", filepath.Join(root, "file.bin"), nil},
+		{"dir/new/file.bin", filepath.Join(root, "dir", "new", "file.bin"), nil},
+		{"inner/file.bin", filepath.Join(root, "dir", "file.bin"), nil},
+		{"escape/file.bin", "", ErrSymlinkEscape},
+		{"escape", "", ErrSymlinkEscape},
+		{"dangling", "", ErrSymlinkEscape},
+		{"../file.bin", "", ErrPathTraversal},
+		{"/file.bin", "", ErrAbsolutePath},
+	}
+	for _, tt := range tests {
+		got, err := ResolvePath(root, tt.name)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("ResolvePath(%q) = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestResolveEntryKeepsLink(t *testing.T) {
+	root := newTestRoot(t)
+	outside := newTestRoot(t)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	// DELETE ссылки удаляет саму ссылку, а не каталог за пределами корня
+	got, err := ResolveEntry(root, "escape")
+	if err != nil || got != filepath.Join(root, "escape") {
+		t.Errorf("ResolveEntry(escape) = %q, %v; want the link itself", got, err)
+	}
+	if _, err := ResolveEntry(root, "escape/file.bin"); !errors.Is(err, ErrSymlinkEscape) {
+		t.Errorf("ResolveEntry(escape/file.bin) = %v, want %v", err, ErrSymlinkEscape)
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/srv/root", true},
+		{"/srv/root/a/b", true},
+		{"/srv/root/..hidden", true},
+		{"/srv/rootfiles", false},
+		{"/srv", false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := isWithin("/srv/root", tt.path); got != tt.want {
+			t.Errorf("isWithin(/srv/root, %q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOpenPartialLocks(t *testing.T) {
+	root := newTestRoot(t)
+	path := filepath.Join(root, "file.bin")
+
+	file, partPath, _, err := OpenPartial(root, path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := OpenPartial(root, path, 4); !errors.Is(err, ErrUploadInProgress) {
+		t.Fatalf("second OpenPartial = %v, want %v", err, ErrUploadInProgress)
+	}
+
+	// После прерванной загрузки файл снова можно открыть и продолжить
+	if _, err := file.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	file, partPath, offset, err := OpenPartial(root, path, 4)
+	if err != nil || offset != 2 {
+		t.Fatalf("OpenPartial after abort = %d, %v; want 2, nil", offset, err)
+	}
+
+	if err := CommitPartial(file, partPath, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Errorf("partial file still exists after commit: %v", err)
+	}
+	next, _, offset, err := OpenPartial(root, path, 4)
+	if err != nil || offset != 0 {
+		t.Fatalf("OpenPartial after commit = %d, %v; want 0, nil", offset, err)
+	}
+	next.Close()
+}
+
+func TestListHidesStaging(t *testing.T) {
+	root := newTestRoot(t)
+	for _, dir := range []string{StagingDir, "public/ing/" + StagingDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Корень гостя и загрузчика лежит внутри корня администратора
+	for _, dir := range []string{"", "public/ing"} {
+		lines, err := List(root, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range lines {
+			if strings.HasSuffix(line, " "+StagingDir) {
+				t.Errorf("List(%q) shows the staging directory: %q", dir, line)
+			}
+		}
+	}
+}
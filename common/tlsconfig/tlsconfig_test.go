@@ -0,0 +1,229 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client certificate, all written as PEM files
+type testPKI struct {
+	caFile, serverCert, serverKey, clientCert, clientKey string
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki := testPKI{caFile: filepath.Join(dir, "ca.pem")}
+	writePEM(t, pki.caFile, "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	pki.serverCert, pki.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	pki.clientCert, pki.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake runs a TLS handshake between a listener with server and a
+// client dialing it with client
+func handshake(t *testing.T, server, client *tls.Config) error {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		err = conn.(*tls.Conn).Handshake()
+		if err == nil {
+			_, err = conn.Write([]byte("ok\n"))
+		}
+		serverErr <- err
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err == nil {
+		// С TLS 1.3 отказ сервера виден только при первом чтении
+		_, err = io.ReadFull(conn, make([]byte, 3))
+		conn.Close()
+	}
+	if sErr := <-serverErr; err == nil {
+		err = sErr
+	}
+	return err
+}
+
+// configs builds a server and a client config from the test PKI, failing the test on errors
+func configs(t *testing.T, pki testPKI, clientCA bool, clientCert bool) (*tls.Config, *tls.Config) {
+	t.Helper()
+	caFile, certFile, keyFile := "", "", ""
+	if clientCA {
+		caFile = pki.caFile
+	}
+	server, err := Server(pki.serverCert, pki.serverKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientCert {
+		certFile, keyFile = pki.clientCert, pki.clientKey
+	}
+	client, err := Client(pki.caFile, certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestServerDisabled(t *testing.T) {
+	config, err := Server("", "", "")
+	if err != nil || config != nil {
+		t.Fatalf("Server without files = %v, %v; want nil, nil", config, err)
+	}
+	if _, err := Server("", "", "ca.pem"); err == nil {
+		t.Fatal("-tls-client-ca without a certificate was accepted")
+	}
+}
+
+func TestServerBadFiles(t *testing.T) {
+	pki := newTestPKI(t)
+	if _, err := Server(pki.serverCert, pki.caFile, ""); err == nil {
+		t.Error("certificate with a mismatched key was accepted")
+	}
+	if _, err := Server(pki.serverCert, pki.serverKey, pki.serverKey); err == nil {
+		t.Error("client CA file without certificates was accepted")
+	}
+}
+
+func TestClientBadFiles(t *testing.T) {
+	pki := newTestPKI(t)
+	if _, err := Client(filepath.Join(t.TempDir(), "missing.pem"), "", "", ""); err == nil {
+		t.Error("missing CA file was accepted")
+	}
+	if _, err := Client(pki.serverKey, "", "", ""); err == nil {
+		t.Error("CA file without certificates was accepted")
+	}
+	if _, err := Client(pki.caFile, pki.clientCert, "", ""); err == nil {
+		t.Error("client certificate without a key was accepted")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	server, client := configs(t, pki, false, false)
+	if server.MinVersion < tls.VersionTLS12 || client.MinVersion < tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x and %x, want at least TLS 1.2", server.MinVersion, client.MinVersion)
+	}
+	if err := handshake(t, server, client); err != nil {
+		t.Fatalf("handshake without client certificate: %v", err)
+	}
+}
+
+func TestClientVerifiesServer(t *testing.T) {
+	pki := newTestPKI(t)
+	server, _ := configs(t, pki, false, false)
+
+	// Без CA сертификат сервера проверяется системными корнями и не проходит
+	untrusting, err := Client("", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, server, untrusting); err == nil {
+		t.Error("server signed by an unknown CA was trusted")
+	}
+
+	renamed, err := Client(pki.caFile, "", "", "files.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, server, renamed); err == nil {
+		t.Error("certificate for 127.0.0.1 matched server name files.example")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	server, client := configs(t, pki, true, true)
+	if err := handshake(t, server, client); err != nil {
+		t.Fatalf("handshake with client certificate: %v", err)
+	}
+
+	_, anonymous := configs(t, pki, true, false)
+	if err := handshake(t, server, anonymous); err == nil {
+		t.Fatal("client without a certificate passed mutual TLS")
+	}
+}
@@ -0,0 +1,53 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+// The sender of a file announces the SHA-256 of the whole file after the
+// last frame on TCP, or in the MsgClose payload on UDP. The receiver hashes
+// what it wrote and answers with DigestOK or "DigestMismatch <its hash>".
+const (
+	DigestPrefix   = "SHA256 "
+	DigestOK       = "SHA256 OK"
+	DigestMismatch = "SHA256 MISMATCH"
+)
+
+var ErrBadDigest = errors.New("malformed SHA256 announcement")
+
+func FormatDigest(h hash.Hash) string {
+	return DigestPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// ParseDigest returns the hex digest of a "SHA256 <hex>" line
+func ParseDigest(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, DigestPrefix) {
+		return "", ErrBadDigest
+	}
+
+	digest := strings.ToLower(strings.TrimPrefix(line, DigestPrefix))
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+		return "", ErrBadDigest
+	}
+	return digest, nil
+}
+
+// HashFile hashes the first n bytes of file, a resumed transfer uses it
+// to account for the part that was written earlier
+func HashFile(file io.ReaderAt, n int64) (hash.Hash, error) {
+	h := sha256.New()
+	copied, err := io.Copy(h, io.NewSectionReader(file, 0, n))
+	if err != nil {
+		return nil, err
+	}
+	if copied != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return h, nil
+}
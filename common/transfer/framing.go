@@ -0,0 +1,85 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// File contents on the TCP channel are sent as a sequence of frames.
+// Every frame is a 4-byte big-endian payload length followed by the payload,
+// a frame with zero length marks the end of the file.
+const (
+	FrameHeaderSize = 4
+	FrameSize       = 4096        // Payload size of frames we send
+	MaxFrameSize    = 1024 * 1024 // Largest frame we accept from the peer
+)
+
+func WriteFrames(w io.Writer, src io.Reader) (int64, error) {
+	buffer := make([]byte, FrameHeaderSize+FrameSize)
+	total := int64(0)
+
+	for {
+		n, err := src.Read(buffer[FrameHeaderSize:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buffer[:FrameHeaderSize], uint32(n))
+			if _, werr := w.Write(buffer[:FrameHeaderSize+n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, WriteFrameEnd(w)
+}
+
+func WriteFrameEnd(w io.Writer) error {
+	_, err := w.Write(make([]byte, FrameHeaderSize))
+	return err
+}
+
+// ReadFrames copies frame payloads to dst until the terminating empty frame.
+// A failing dst does not stop reading: the rest of the stream is drained so
+// the connection stays usable and the write error is reported separately
+// from errors of the stream itself.
+func ReadFrames(r io.Reader, dst io.Writer) (total int64, writeErr error, err error) {
+	header := make([]byte, FrameHeaderSize)
+	buffer := make([]byte, FrameSize)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return total, writeErr, err
+		}
+
+		remaining := int(binary.BigEndian.Uint32(header))
+		if remaining == 0 {
+			return total, writeErr, nil
+		}
+		if remaining > MaxFrameSize {
+			return total, writeErr, fmt.Errorf("frame too large: %d bytes", remaining)
+		}
+
+		for remaining > 0 {
+			chunk := min(remaining, len(buffer))
+			if _, err := io.ReadFull(r, buffer[:chunk]); err != nil {
+				return total, writeErr, err
+			}
+			remaining -= chunk
+
+			if writeErr != nil {
+				continue
+			}
+			if _, err := dst.Write(buffer[:chunk]); err != nil {
+				writeErr = err
+				continue
+			}
+			total += int64(chunk)
+		}
+	}
+}
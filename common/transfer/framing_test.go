@@ -0,0 +1,144 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// testPayload spans several frames and contains the old "EOF\n" marker and every byte value
+func testPayload() []byte {
+	var data []byte
+	for len(data) < 3*FrameSize+17 {
+		data = append(data, "EOF\n"...)
+		for b := 0; b < 256; b++ {
+			data = append(data, byte(b))
+		}
+	}
+	return data
+}
+
+// failingWriter accepts limit bytes and fails every write after that
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		return 0, errDiskFull
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestFramesRoundTrip(t *testing.T) {
+	data := testPayload()
+	tests := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"whole reads", func(r io.Reader) io.Reader { return r }},
+		{"one byte reads", iotest.OneByteReader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			n, err := WriteFrames(&stream, tt.wrap(bytes.NewReader(data)))
+			if err != nil || n != int64(len(data)) {
+				t.Fatalf("WriteFrames = %d, %v; want %d, nil", n, err, len(data))
+			}
+			// За концом файла в соединении идут следующие строки протокола
+			stream.WriteString("SHA256 after\n")
+
+			var got bytes.Buffer
+			r := tt.wrap(&stream)
+			total, writeErr, err := ReadFrames(r, &got)
+			if err != nil || writeErr != nil {
+				t.Fatalf("ReadFrames errors: write %v, stream %v", writeErr, err)
+			}
+			if total != int64(len(data)) || !bytes.Equal(got.Bytes(), data) {
+				t.Fatalf("ReadFrames returned %d bytes, data equal %v; want %d", total, bytes.Equal(got.Bytes(), data), len(data))
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "SHA256 after\n" {
+				t.Errorf("ReadFrames left %q in the stream, want the next protocol line", rest)
+			}
+		})
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	var stream bytes.Buffer
+	if n, err := WriteFrames(&stream, bytes.NewReader(nil)); n != 0 || err != nil {
+		t.Fatalf("WriteFrames of an empty file = %d, %v", n, err)
+	}
+	if !bytes.Equal(stream.Bytes(), make([]byte, FrameHeaderSize)) {
+		t.Fatalf("empty file was sent as %x, want only the zero length end frame", stream.Bytes())
+	}
+
+	var got bytes.Buffer
+	total, writeErr, err := ReadFrames(&stream, &got)
+	if total != 0 || writeErr != nil || err != nil || got.Len() != 0 {
+		t.Errorf("ReadFrames of an empty file = %d, %v, %v", total, writeErr, err)
+	}
+}
+
+func TestReadFramesRejectsLargeFrame(t *testing.T) {
+	header := make([]byte, FrameHeaderSize)
+	binary.BigEndian.PutUint32(header, MaxFrameSize+1)
+	stream := append(header, make([]byte, 16)...)
+
+	var got bytes.Buffer
+	if _, _, err := ReadFrames(bytes.NewReader(stream), &got); err == nil {
+		t.Fatal("frame above MaxFrameSize was accepted")
+	}
+	if got.Len() != 0 {
+		t.Errorf("%d bytes of an oversized frame were written", got.Len())
+	}
+
+	// Кадр ровно MaxFrameSize допустим
+	binary.BigEndian.PutUint32(header, MaxFrameSize)
+	stream = append(append(header, make([]byte, MaxFrameSize)...), make([]byte, FrameHeaderSize)...)
+	if total, _, err := ReadFrames(bytes.NewReader(stream), &got); err != nil || total != MaxFrameSize {
+		t.Errorf("frame of MaxFrameSize = %d, %v", total, err)
+	}
+}
+
+func TestReadFramesTruncated(t *testing.T) {
+	var stream bytes.Buffer
+	WriteFrames(&stream, bytes.NewReader(testPayload()))
+	cut := stream.Bytes()[:FrameHeaderSize+FrameSize/2]
+
+	if _, _, err := ReadFrames(bytes.NewReader(cut), io.Discard); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadFrames of a cut stream = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReadFramesDrainsAfterWriteError(t *testing.T) {
+	data := testPayload()
+	var stream bytes.Buffer
+	WriteFrames(&stream, bytes.NewReader(data))
+	stream.WriteString("next\n")
+
+	// Ошибка записи не останавливает чтение, иначе остаток файла
+	// был бы принят за следующие команды
+	dst := &failingWriter{limit: FrameSize + 100}
+	total, writeErr, err := ReadFrames(&stream, dst)
+	if err != nil {
+		t.Fatalf("ReadFrames stream error: %v", err)
+	}
+	if !errors.Is(writeErr, errDiskFull) {
+		t.Errorf("ReadFrames write error = %v, want %v", writeErr, errDiskFull)
+	}
+	if total != int64(dst.written) || total >= int64(len(data)) {
+		t.Errorf("ReadFrames reported %d bytes, %d were written", total, dst.written)
+	}
+	if rest := stream.String(); rest != "next\n" {
+		t.Errorf("ReadFrames left %q in the stream, want %q", rest, "next\n")
+	}
+}
@@ -0,0 +1,68 @@
+package udp
+
+// SlidingWindow is the initial congestion window in chunks
+const SlidingWindow = 8
+
+// MinWindow is the floor of the congestion window. Random loss on a lossy
+// link alone should not throttle a transfer below the initial window.
+const MinWindow = SlidingWindow
+
+// MaxWindow caps the congestion window, set from the -max-window flag
+var MaxWindow = 512
+
+// CongestionWindow limits how many chunks may be in flight. It starts at
+// SlidingWindow and grows exponentially in slow start, then by one chunk
+// per window of ACKs. A lost chunk halves it, a timeout drops it to
+// MinWindow and restarts slow start.
+type CongestionWindow struct {
+	cwnd     float64
+	ssthresh float64
+	max      float64
+
+	// Chunks below this one were sent before the last decrease, their
+	// losses belong to the same congestion event
+	recovery uint32
+}
+
+func NewCongestionWindow(initial, maxWindow int) *CongestionWindow {
+	maxWindow = max(maxWindow, MinWindow)
+	return &CongestionWindow{
+		cwnd:     float64(min(max(initial, MinWindow), maxWindow)),
+		ssthresh: float64(maxWindow),
+		max:      float64(maxWindow),
+	}
+}
+
+func (w *CongestionWindow) Size() int {
+	return int(w.cwnd)
+}
+
+// acked grows the window for n newly acknowledged chunks
+func (w *CongestionWindow) acked(n int) {
+	for ; n > 0; n-- {
+		if w.cwnd < w.ssthresh {
+			w.cwnd++
+		} else {
+			w.cwnd += 1 / w.cwnd
+		}
+	}
+	w.cwnd = min(w.cwnd, w.max)
+}
+
+// lost halves the window once per congestion event. seq is the lost chunk,
+// next is the first chunk that was never sent.
+func (w *CongestionWindow) lost(seq, next uint32) {
+	if seq < w.recovery {
+		return
+	}
+	w.ssthresh = max(w.cwnd/2, MinWindow)
+	w.cwnd = w.ssthresh
+	w.recovery = next
+}
+
+// timedOut falls back to slow start after a retransmission timer fired
+func (w *CongestionWindow) timedOut(inflight int, next uint32) {
+	w.ssthresh = max(float64(inflight)/2, MinWindow)
+	w.cwnd = MinWindow
+	w.recovery = next
+}
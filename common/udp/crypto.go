@@ -0,0 +1,230 @@
+package udp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Transfers are encrypted when both sides are given the same key with
+// -psk-file. The client picks a random salt and sends it in clear in front
+// of the sealed MsgOpen, which is sealed with an open key derived from the
+// key and that salt with HKDF-SHA256. The server answers with a random salt
+// of its own in clear in front of MsgOpenAck and MsgError. Everything else
+// is sealed with one AES-256-GCM session key per direction derived from both
+// salts, so a replayed MsgOpen never brings back the keys of an old session.
+// A sealed payload is
+//
+//	counter    uint64  datagrams sealed so far by this side, never repeats under one key
+//	ciphertext         the original payload followed by the GCM tag
+//
+// The nonce is seq and counter, the header is authenticated as additional
+// data, so a datagram cannot be moved to another session or chunk. Counters
+// seen before are dropped as replays.
+const (
+	SaltSize     = 16
+	CounterSize  = 8
+	SealOverhead = CounterSize + 16 // Counter and GCM tag
+	MinKeySize   = 16
+	ReplayWindow = 1024 // Counters this far behind the newest one are dropped
+)
+
+// PreSharedKey enables encrypted transfers, set from the -psk-file flag
+var PreSharedKey []byte
+
+var (
+	ErrBadSeal = errors.New("datagram authentication failed")
+	errReplay  = errors.New("replayed datagram")
+)
+
+// LoadPreSharedKey reads the key from file, surrounding whitespace is ignored
+func LoadPreSharedKey(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read key file: %v", err)
+	}
+
+	key := bytes.TrimSpace(data)
+	if len(key) < MinKeySize {
+		return fmt.Errorf("key in %s is shorter than %d bytes", file, MinKeySize)
+	}
+	PreSharedKey = key
+	return nil
+}
+
+// Cipher seals the datagrams of one transfer session
+type Cipher struct {
+	opener cipher.AEAD // Key of MsgOpen, derived from the client salt alone
+	send   cipher.AEAD // Session keys, nil until the server salt is known
+	recv   cipher.AEAD
+
+	psk        []byte
+	clientSalt []byte
+	server     bool
+	counter    uint64
+	replay     replayWindow
+}
+
+func NewCipher(psk, clientSalt []byte, server bool) (*Cipher, error) {
+	opener, err := newAEAD(psk, clientSalt, "client open")
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{opener: opener, psk: psk, clientSalt: clientSalt, server: server}, nil
+}
+
+// StartSession derives the session keys from both salts
+func (c *Cipher) StartSession(serverSalt []byte) error {
+	salt := append(append([]byte(nil), c.clientSalt...), serverSalt...)
+	toServer, err := newAEAD(c.psk, salt, "client to server")
+	if err != nil {
+		return err
+	}
+	toClient, err := newAEAD(c.psk, salt, "server to client")
+	if err != nil {
+		return err
+	}
+
+	if c.server {
+		c.send, c.recv = toClient, toServer
+	} else {
+		c.send, c.recv = toServer, toClient
+	}
+	return nil
+}
+
+func (c *Cipher) Started() bool {
+	return c.send != nil
+}
+
+// OpenFirst opens the first reply of the server, which carries the server
+// salt. The session keys are kept only if the reply authenticates with them,
+// so a forged reply cannot plant a salt of its own.
+func (c *Cipher) OpenFirst(h Header, serverSalt, sealed []byte) ([]byte, error) {
+	if err := c.StartSession(serverSalt); err != nil {
+		return nil, err
+	}
+	payload, err := c.Open(h, sealed)
+	if err != nil {
+		c.send, c.recv = nil, nil
+	}
+	return payload, err
+}
+
+func newAEAD(psk, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, psk, salt, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encodes a datagram with FlagSealed, prefix is sent in clear before
+// the counter. Only MsgOpen may be sealed before startSession.
+func (c *Cipher) Seal(msgType uint8, session, seq uint32, prefix, payload []byte) []byte {
+	c.counter++
+	size := HeaderSize + len(prefix) + SealOverhead + len(payload)
+
+	buf := make([]byte, size)
+	putHeader(buf, msgType|FlagSealed, session, seq)
+	copy(buf[HeaderSize:], prefix)
+	counterAt := HeaderSize + len(prefix)
+	binary.BigEndian.PutUint64(buf[counterAt:], c.counter)
+
+	// Заголовок без контрольной суммы идет в AAD, сумма считается уже по шифртексту
+	aad := append([]byte(nil), buf[:14]...)
+	key := c.send
+	if msgType == MsgOpen {
+		key = c.opener
+	}
+	key.Seal(buf[counterAt+CounterSize:counterAt+CounterSize], sealNonce(seq, c.counter), payload, aad)
+	binary.BigEndian.PutUint32(buf[14:18], datagramChecksum(buf))
+	return buf
+}
+
+// Open authenticates and decrypts a sealed payload whose clear prefix is already stripped
+func (c *Cipher) Open(h Header, sealed []byte) ([]byte, error) {
+	if !h.Sealed || len(sealed) < SealOverhead {
+		return nil, ErrBadSeal
+	}
+
+	key := c.recv
+	if h.Type == MsgOpen {
+		key = c.opener
+	}
+	if key == nil {
+		return nil, ErrBadSeal
+	}
+
+	counter := binary.BigEndian.Uint64(sealed)
+	if !c.replay.fresh(counter) {
+		return nil, errReplay
+	}
+
+	payload, err := key.Open(nil, sealNonce(h.Seq, counter), sealed[CounterSize:], headerAAD(h))
+	if err != nil {
+		return nil, ErrBadSeal
+	}
+	// Счетчик запоминаем только после проверки, иначе подделка вытеснит настоящий пакет
+	c.replay.Accept(counter)
+	return payload, nil
+}
+
+func sealNonce(seq uint32, counter uint64) []byte {
+	nonce := make([]byte, 4+CounterSize)
+	binary.BigEndian.PutUint32(nonce[0:4], seq)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// headerAAD rebuilds the header of a sealed datagram without its checksum
+func headerAAD(h Header) []byte {
+	aad := make([]byte, 14)
+	binary.BigEndian.PutUint16(aad[0:2], HeaderMagic)
+	aad[2] = ProtocolVersion
+	aad[3] = h.Type | FlagSealed
+	binary.BigEndian.PutUint32(aad[4:8], h.Session)
+	binary.BigEndian.PutUint32(aad[8:12], h.Seq)
+	binary.BigEndian.PutUint16(aad[12:14], h.Length)
+	return aad
+}
+
+// replayWindow remembers which of the last ReplayWindow counters were received
+type replayWindow struct {
+	newest uint64
+	seen   [ReplayWindow]bool
+}
+
+func (w *replayWindow) fresh(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > w.newest {
+		return true
+	}
+	if w.newest-counter >= ReplayWindow {
+		return false
+	}
+	return !w.seen[counter%ReplayWindow]
+}
+
+func (w *replayWindow) Accept(counter uint64) {
+	if counter > w.newest {
+		// Ячейки, которые займут новые счетчики, освобождаем
+		for c := w.newest + 1; c < counter && c <= w.newest+ReplayWindow; c++ {
+			w.seen[c%ReplayWindow] = false
+		}
+		w.newest = counter
+	}
+	w.seen[counter%ReplayWindow] = true
+}
@@ -0,0 +1,169 @@
+package udp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var testPSK = []byte("0123456789abcdef0123456789abcdef")
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	if w.fresh(0) {
+		t.Error("counter 0 is never sent and must be rejected")
+	}
+
+	for _, c := range []uint64{1, 3, 2, 10} {
+		if !w.fresh(c) {
+			t.Fatalf("counter %d rejected before it was seen", c)
+		}
+		w.Accept(c)
+	}
+	for _, c := range []uint64{1, 2, 3, 10} {
+		if w.fresh(c) {
+			t.Errorf("counter %d accepted twice", c)
+		}
+	}
+	// Пропущенные счетчики внутри окна еще могут прийти
+	if !w.fresh(5) {
+		t.Error("counter 5 behind the newest one was rejected")
+	}
+
+	w.Accept(10 + ReplayWindow)
+	if w.fresh(10) {
+		t.Error("counter 10 accepted after the window moved past it")
+	}
+	if !w.fresh(11) {
+		t.Error("unseen counter inside the moved window was rejected")
+	}
+
+	// Ячейки, освобожденные сдвигом окна, не должны помнить старые счетчики
+	w.Accept(10 + 2*ReplayWindow + 5)
+	if !w.fresh(10 + 2*ReplayWindow) {
+		t.Error("counter reusing a slot of an old one was rejected")
+	}
+}
+
+// newTestSession runs the open handshake of a client and a server cipher
+func newTestSession(t *testing.T) (client, server *Cipher, open []byte) {
+	t.Helper()
+	salt := bytes.Repeat([]byte{1}, SaltSize)
+	client, err := NewCipher(testPSK, salt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open = client.Seal(MsgOpen, 0, 7, salt, []byte("DOWNLOAD file.bin 0"))
+
+	server = acceptTestOpen(t, open)
+	serverSalt := bytes.Repeat([]byte{2}, SaltSize)
+	if err := server.StartSession(serverSalt); err != nil {
+		t.Fatal(err)
+	}
+
+	h, payload := decodeTest(t, server.Seal(MsgOpenAck, 42, 7, serverSalt, []byte("SIZE 10")))
+	if _, err := client.OpenFirst(h, payload[:SaltSize], payload[SaltSize:]); err != nil {
+		t.Fatalf("client could not open MsgOpenAck: %v", err)
+	}
+	return client, server, open
+}
+
+func acceptTestOpen(t *testing.T, open []byte) *Cipher {
+	t.Helper()
+	h, payload := decodeTest(t, open)
+	server, err := NewCipher(testPSK, payload[:SaltSize], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Open(h, payload[SaltSize:]); err != nil {
+		t.Fatalf("server could not open MsgOpen: %v", err)
+	}
+	return server
+}
+
+func decodeTest(t *testing.T, datagram []byte) (Header, []byte) {
+	t.Helper()
+	h, payload, err := DecodeDatagram(datagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, payload
+}
+
+func TestTransferCipherRoundTrip(t *testing.T) {
+	client, server, _ := newTestSession(t)
+
+	datagram := server.Seal(MsgData, 42, 0, nil, []byte("chunk"))
+	h, payload := decodeTest(t, datagram)
+	got, err := client.Open(h, payload)
+	if err != nil || string(got) != "chunk" {
+		t.Fatalf("open = %q, %v; want chunk", got, err)
+	}
+	if _, err := client.Open(h, payload); !errors.Is(err, errReplay) {
+		t.Errorf("second open of the same datagram = %v, want %v", err, errReplay)
+	}
+
+	// Заголовок входит в AAD: чанк нельзя перенести в другую сессию
+	h, payload = decodeTest(t, server.Seal(MsgData, 42, 1, nil, []byte("chunk")))
+	h.Session = 43
+	if _, err := client.Open(h, payload); !errors.Is(err, ErrBadSeal) {
+		t.Errorf("datagram moved to another session = %v, want %v", err, ErrBadSeal)
+	}
+}
+
+func TestTransferCipherReplayedOpen(t *testing.T) {
+	client, server, open := newTestSession(t)
+
+	// Повторенный MsgOpen открывается, но сервер выбирает новую соль,
+	// и ключи новой сессии не совпадают со старыми
+	replayed := acceptTestOpen(t, open)
+	replayedSalt := bytes.Repeat([]byte{3}, SaltSize)
+	if err := replayed.StartSession(replayedSalt); err != nil {
+		t.Fatal(err)
+	}
+	replayed.Seal(MsgOpenAck, 42, 7, replayedSalt, []byte("SIZE 10"))
+
+	// Счетчики обеих сессий совпадают, прежние ключи дали бы тот же шифртекст
+	old := server.Seal(MsgData, 42, 0, nil, []byte("secret"))
+	again := replayed.Seal(MsgData, 42, 0, nil, []byte("secret"))
+	if bytes.Equal(old[HeaderSize:], again[HeaderSize:]) {
+		t.Fatal("replayed open reused the keys of the old session")
+	}
+
+	h, payload := decodeTest(t, again)
+	if _, err := client.Open(h, payload); !errors.Is(err, ErrBadSeal) {
+		t.Errorf("datagram of the replayed session = %v, want %v", err, ErrBadSeal)
+	}
+}
+
+func TestOpenFirstRejectsForgedSalt(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, SaltSize)
+	client, err := NewCipher(testPSK, salt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := client.Seal(MsgOpen, 0, 7, salt, []byte("COMMAND"))
+	server := acceptTestOpen(t, open)
+	serverSalt := bytes.Repeat([]byte{2}, SaltSize)
+	if err := server.StartSession(serverSalt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Подделанный ответ с чужой солью не должен закрепить свои ключи
+	forged := server.Seal(MsgOpenAck, 42, 7, serverSalt, []byte("READY"))
+	h, payload := decodeTest(t, forged)
+	if _, err := client.OpenFirst(h, bytes.Repeat([]byte{9}, SaltSize), payload[SaltSize:]); err == nil {
+		t.Fatal("reply under a forged salt was accepted")
+	}
+	if client.Started() {
+		t.Fatal("forged salt left session keys behind")
+	}
+
+	h, payload = decodeTest(t, server.Seal(MsgOpenAck, 42, 7, serverSalt, []byte("READY")))
+	if got, err := client.OpenFirst(h, payload[:SaltSize], payload[SaltSize:]); err != nil || string(got) != "READY" {
+		t.Fatalf("openFirst = %q, %v; want READY", got, err)
+	}
+	if !client.Started() {
+		t.Error("session keys were not kept after a valid reply")
+	}
+}
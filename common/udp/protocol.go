@@ -0,0 +1,122 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Every datagram of a file transfer starts with a fixed header, big-endian:
+//
+//	magic    uint16  HeaderMagic
+//	version  uint8   ProtocolVersion
+//	type     uint8   one of the Msg* constants, FlagSealed if the payload is encrypted
+//	session  uint32  assigned by the server in MsgOpenAck, 0 in MsgOpen
+//	seq      uint32  chunk number, acknowledged chunk count or open token
+//	length   uint16  payload length
+//	checksum uint32  CRC32C of the header with this field zeroed and the payload
+//
+// Plain text datagrams (ECHO, TIME, LIST, ...) never start with the magic,
+// a server with -psk-file takes text commands only sealed in MsgCommand.
+// The checksum guards against links where UDP checksums are disabled, a
+// corrupted datagram is dropped and recovered like a lost one.
+const (
+	DatagramSize    = 1500 // Recommended datagram size per ethernet mtu limitations
+	HeaderMagic     = 0xD5F1
+	ProtocolVersion = 4
+	HeaderSize      = 18
+	ChunkSize       = DatagramSize - HeaderSize - SealOverhead // File bytes carried by one MsgData
+	FlagSealed      = 0x80
+)
+
+const (
+	MsgOpen     = 1 // client: "UPLOAD <name> <size>" or "DOWNLOAD <name> <offset>", seq is a client token
+	MsgOpenAck  = 2 // server: "READY: Offset <committed bytes>" or "SIZE <bytes>", seq echoes the token
+	MsgData     = 3 // seq is the chunk number counted from the transfer offset
+	MsgAck      = 4 // seq is the number of chunks received in order, payload is the SACK bitmap
+	MsgClose    = 5 // sender has no more data, seq is the total number of chunks
+	MsgCloseAck = 6 // receiver's final status
+	MsgError    = 7 // payload explains why the transfer is aborted
+	MsgCommand  = 8 // client: a text command of an encrypted client, after the open handshake
+	MsgReply    = 9 // server: the reply to MsgCommand, seq echoes it
+)
+
+// CommandSession is the MsgOpen request of an encrypted client that sends a
+// text command, the command itself follows in MsgCommand under the session keys
+const CommandSession = "COMMAND"
+
+var (
+	errShortDatagram = errors.New("datagram shorter than header")
+	errBadMagic      = errors.New("not a transfer datagram")
+	errBadVersion    = errors.New("unsupported protocol version")
+	errBadLength     = errors.New("payload length mismatch")
+	ErrBadChecksum   = errors.New("checksum mismatch")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type Header struct {
+	Type    uint8
+	Sealed  bool
+	Session uint32
+	Seq     uint32
+	Length  uint16
+}
+
+func IsTransferDatagram(data []byte) bool {
+	return len(data) >= 2 && binary.BigEndian.Uint16(data[0:2]) == HeaderMagic
+}
+
+func EncodeDatagram(msgType uint8, session, seq uint32, payload []byte) []byte {
+	buf := make([]byte, HeaderSize+len(payload))
+	putHeader(buf, msgType, session, seq)
+	copy(buf[HeaderSize:], payload)
+	binary.BigEndian.PutUint32(buf[14:18], datagramChecksum(buf))
+	return buf
+}
+
+// putHeader fills everything but the checksum, the payload length is taken from len(buf)
+func putHeader(buf []byte, msgType uint8, session, seq uint32) {
+	binary.BigEndian.PutUint16(buf[0:2], HeaderMagic)
+	buf[2] = ProtocolVersion
+	buf[3] = msgType
+	binary.BigEndian.PutUint32(buf[4:8], session)
+	binary.BigEndian.PutUint32(buf[8:12], seq)
+	binary.BigEndian.PutUint16(buf[12:14], uint16(len(buf)-HeaderSize))
+}
+
+// datagramChecksum computes the CRC32C of an encoded datagram as if its checksum field were zero
+func datagramChecksum(data []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, data[:14])
+	crc = crc32.Update(crc, castagnoli, make([]byte, 4))
+	return crc32.Update(crc, castagnoli, data[HeaderSize:])
+}
+
+// DecodeDatagram parses a transfer datagram. On errBadChecksum the header is
+// returned as well, it tells whose datagram was corrupted if it can be trusted.
+func DecodeDatagram(data []byte) (Header, []byte, error) {
+	var h Header
+	if len(data) < HeaderSize {
+		return h, nil, errShortDatagram
+	}
+	if !IsTransferDatagram(data) {
+		return h, nil, errBadMagic
+	}
+	if data[2] != ProtocolVersion {
+		return h, nil, errBadVersion
+	}
+
+	h.Type = data[3] &^ FlagSealed
+	h.Sealed = data[3]&FlagSealed != 0
+	h.Session = binary.BigEndian.Uint32(data[4:8])
+	h.Seq = binary.BigEndian.Uint32(data[8:12])
+	h.Length = binary.BigEndian.Uint16(data[12:14])
+
+	if int(h.Length) != len(data)-HeaderSize {
+		return h, nil, errBadLength
+	}
+	if binary.BigEndian.Uint32(data[14:18]) != datagramChecksum(data) {
+		return h, nil, ErrBadChecksum
+	}
+	return h, data[HeaderSize:], nil
+}
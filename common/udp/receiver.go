@@ -0,0 +1,120 @@
+package udp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	MaxPendingChunks = 4096 // Out-of-order chunks kept in memory while waiting for a gap
+	SackBitmapSize   = 128  // Bytes of SACK bitmap in a MsgAck, covers 1024 chunks past the gap
+)
+
+// ChunkReceiver writes the chunks of a transfer at their offsets. Chunks that
+// arrive ahead of a gap are kept until the gap is filled, so the file always
+// grows front to back and a resumed transfer can trust its length. The same
+// order lets the receiver hash the file while writing it.
+type ChunkReceiver struct {
+	file    io.WriterAt
+	base    int64  // File offset of chunk 0
+	next    uint32 // First chunk that has not been written yet
+	written int64  // Bytes written after base
+	pending map[uint32][]byte
+	hash    hash.Hash // Covers the whole file, including the part before base
+}
+
+func NewChunkReceiver(file io.WriterAt, base int64, h hash.Hash) *ChunkReceiver {
+	return &ChunkReceiver{
+		file:    file,
+		base:    base,
+		pending: make(map[uint32][]byte),
+		hash:    h,
+	}
+}
+
+// Accept takes one MsgData payload. Duplicates are ignored and chunks beyond
+// MaxPendingChunks are dropped, the sender will repeat them.
+func (r *ChunkReceiver) Accept(seq uint32, data []byte) error {
+	if len(data) > ChunkSize {
+		return nil
+	}
+
+	if seq < r.next {
+		return nil
+	}
+
+	if seq > r.next {
+		if _, exists := r.pending[seq]; !exists && len(r.pending) < MaxPendingChunks {
+			r.pending[seq] = append([]byte(nil), data...)
+		}
+		return nil
+	}
+
+	if err := r.write(seq, data); err != nil {
+		return err
+	}
+
+	for {
+		nextData, ok := r.pending[r.next]
+		if !ok {
+			return nil
+		}
+		delete(r.pending, r.next)
+		if err := r.write(r.next, nextData); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *ChunkReceiver) write(seq uint32, data []byte) error {
+	offset := r.base + int64(seq)*ChunkSize
+	if _, err := r.file.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("writing chunk %d: %v", seq, err)
+	}
+	r.hash.Write(data)
+	r.written += int64(len(data))
+	r.next = seq + 1
+	return nil
+}
+
+// Next returns the first chunk that has not been written yet
+func (r *ChunkReceiver) Next() uint32 {
+	return r.next
+}
+
+// Written returns the bytes written after base
+func (r *ChunkReceiver) Written() int64 {
+	return r.written
+}
+
+// Digest returns the hex SHA-256 of everything written so far
+func (r *ChunkReceiver) Digest() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// SackBitmap reports the chunks received past the first gap, bit i stands
+// for chunk next+1+i. Trailing zero bytes are not sent.
+func (r *ChunkReceiver) SackBitmap() []byte {
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	bitmap := make([]byte, SackBitmapSize)
+	used := 0
+	for seq := range r.pending {
+		i := int(seq - r.next - 1)
+		if i >= SackBitmapSize*8 {
+			continue
+		}
+		bitmap[i/8] |= 1 << (i % 8)
+		used = max(used, i/8+1)
+	}
+	return bitmap[:used]
+}
+
+// Complete reports whether all numChunks chunks announced in MsgClose are written
+func (r *ChunkReceiver) Complete(numChunks uint32) bool {
+	return r.next == numChunks && len(r.pending) == 0
+}
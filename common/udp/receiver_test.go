@@ -0,0 +1,110 @@
+package udp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// memFile is an io.WriterAt over a growing byte slice
+type memFile struct{ data []byte }
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+// testChunks splits n chunks of distinct bytes, the last one short
+func testChunks(n int) [][]byte {
+	chunks := make([][]byte, n)
+	for i := range chunks {
+		size := ChunkSize
+		if i == n-1 {
+			size = ChunkSize / 3
+		}
+		chunks[i] = bytes.Repeat([]byte{byte(i + 1)}, size)
+	}
+	return chunks
+}
+
+func TestChunkReceiverReorders(t *testing.T) {
+	chunks := testChunks(5)
+	file := &memFile{}
+	r := NewChunkReceiver(file, 0, sha256.New())
+
+	for _, seq := range []uint32{3, 1, 4, 0, 1, 2} {
+		if err := r.Accept(seq, chunks[seq]); err != nil {
+			t.Fatal(err)
+		}
+		// Файл растет только подряд, без дыр
+		if int64(len(file.data)) != r.written {
+			t.Fatalf("after chunk %d the file has %d bytes but %d are written", seq, len(file.data), r.written)
+		}
+	}
+
+	if !r.Complete(5) {
+		t.Fatalf("receiver is not complete: next %d, %d pending", r.next, len(r.pending))
+	}
+	want := bytes.Join(chunks, nil)
+	if !bytes.Equal(file.data, want) {
+		t.Fatal("reassembled file differs from the chunks sent")
+	}
+	sum := sha256.Sum256(want)
+	if r.Digest() != hex.EncodeToString(sum[:]) {
+		t.Errorf("digest %s, want %x", r.Digest(), sum)
+	}
+}
+
+func TestChunkReceiverBase(t *testing.T) {
+	chunks := testChunks(2)
+	file := &memFile{data: []byte("head")}
+	r := NewChunkReceiver(file, 4, sha256.New())
+	for seq := range chunks {
+		if err := r.Accept(uint32(seq), chunks[seq]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := append([]byte("head"), bytes.Join(chunks, nil)...); !bytes.Equal(file.data, want) {
+		t.Error("chunks of a resumed transfer are not written after base")
+	}
+}
+
+func TestChunkReceiverRejectsOversized(t *testing.T) {
+	r := NewChunkReceiver(&memFile{}, 0, sha256.New())
+	if err := r.Accept(0, make([]byte, ChunkSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if r.next != 0 || r.written != 0 {
+		t.Error("oversized chunk was written")
+	}
+}
+
+func TestChunkReceiverPendingLimit(t *testing.T) {
+	r := NewChunkReceiver(&memFile{}, 0, sha256.New())
+	for seq := uint32(1); seq <= MaxPendingChunks+10; seq++ {
+		r.Accept(seq, []byte{1})
+	}
+	if len(r.pending) != MaxPendingChunks {
+		t.Errorf("%d chunks pending, want at most %d", len(r.pending), MaxPendingChunks)
+	}
+}
+
+func TestSackBitmap(t *testing.T) {
+	r := NewChunkReceiver(&memFile{}, 0, sha256.New())
+	if bitmap := r.SackBitmap(); bitmap != nil {
+		t.Fatalf("bitmap without pending chunks = %x, want none", bitmap)
+	}
+
+	// Бит i означает чанк next+1+i, чанки дальше карты не отмечаются
+	r.Accept(0, []byte{1})
+	for _, seq := range []uint32{3, 6, 17, 1 + SackBitmapSize*8 + 1} {
+		r.Accept(seq, []byte{1})
+	}
+	want := []byte{0x12, 0x80}
+	if bitmap := r.SackBitmap(); !bytes.Equal(bitmap, want) {
+		t.Errorf("bitmap = %x, want %x", bitmap, want)
+	}
+}
@@ -0,0 +1,59 @@
+package udp
+
+import "time"
+
+const (
+	MinRTO     = 10 * time.Millisecond
+	MaxRTO     = 5 * time.Second
+	MaxBackoff = 6 // Timeout doubles at most this many times in a row
+)
+
+// RttEstimator turns RTT samples into a retransmission timeout the way
+// RFC 6298 does: smoothed RTT plus four times its variation, doubled on
+// every expiry until a fresh sample arrives.
+type RttEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	backoff int
+	sampled bool
+}
+
+func NewRttEstimator(initial time.Duration) *RttEstimator {
+	return &RttEstimator{rto: initial}
+}
+
+func (e *RttEstimator) Sample(rtt time.Duration) {
+	if !e.sampled {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.sampled = true
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	e.rto = min(max(e.srtt+4*e.rttvar, MinRTO), MaxRTO)
+	e.backoff = 0
+}
+
+// Expired doubles the timeout after a retransmission timer fired
+func (e *RttEstimator) Expired() {
+	if e.backoff < MaxBackoff {
+		e.backoff++
+	}
+}
+
+func (e *RttEstimator) Timeout() time.Duration {
+	return min(e.rto<<e.backoff, MaxRTO)
+}
+
+// reorderWindow is how much earlier than an acknowledged chunk a missing
+// one may have been sent and still count as reordered rather than lost
+func (e *RttEstimator) reorderWindow() time.Duration {
+	return e.srtt / 4
+}
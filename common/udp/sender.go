@@ -0,0 +1,225 @@
+package udp
+
+import (
+	"io"
+	"time"
+)
+
+const DupAckThreshold = 3 // Chunks acknowledged past a hole before the hole is resent
+
+type inflightChunk struct {
+	sentAt        time.Time
+	acked         bool // Selectively acknowledged, base has not reached it yet
+	retransmitted bool
+}
+
+// ChunkSender keeps the sliding window of one transfer. Chunks are loaded
+// on demand, so resending a chunk never needs the whole file in memory.
+// Only the chunks the receiver is missing are sent again: holes reported
+// by the SACK bitmap and chunks whose own timer expired. The window size
+// follows the congestion controller.
+type ChunkSender struct {
+	numChunks uint32
+	base      uint32 // First chunk the receiver has not written yet
+	next      uint32 // First chunk that was never sent
+	window    *CongestionWindow
+	inflight  map[uint32]*inflightChunk
+	unacked   int // Chunks in inflight not acknowledged in any way
+
+	// Send time of the newest chunk known to be received, anything sent
+	// before it and still missing was lost rather than delayed
+	newestAcked time.Time
+
+	retransmits int
+	rtt         *RttEstimator
+
+	load func(seq uint32) ([]byte, error)
+	send func(seq uint32, data []byte) error
+}
+
+func NewChunkSender(numChunks uint32, window *CongestionWindow, rtt *RttEstimator, load func(uint32) ([]byte, error), send func(uint32, []byte) error) *ChunkSender {
+	return &ChunkSender{
+		numChunks: numChunks,
+		window:    window,
+		rtt:       rtt,
+		inflight:  make(map[uint32]*inflightChunk),
+		load:      load,
+		send:      send,
+	}
+}
+
+// Base returns the first chunk the receiver has not written yet
+func (s *ChunkSender) Base() uint32 {
+	return s.base
+}
+
+// Retransmits returns how many chunks were sent again
+func (s *ChunkSender) Retransmits() int {
+	return s.retransmits
+}
+
+func (s *ChunkSender) Done() bool {
+	return s.base >= s.numChunks
+}
+
+// Fill sends new chunks while the window has room
+func (s *ChunkSender) Fill() error {
+	// Дальше битовой карты SACK уходить нельзя: получатель не сможет сообщить о таких чанках
+	for s.next < s.numChunks && s.unacked < s.window.Size() && s.next-s.base < SackBitmapSize*8 {
+		if err := s.transmit(s.next); err != nil {
+			return err
+		}
+		s.next++
+	}
+	return nil
+}
+
+func (s *ChunkSender) transmit(seq uint32) error {
+	data, err := s.load(seq)
+	if err != nil {
+		return err
+	}
+
+	c, ok := s.inflight[seq]
+	if !ok {
+		c = &inflightChunk{}
+		s.inflight[seq] = c
+		s.unacked++
+	} else {
+		c.retransmitted = true
+		s.retransmits++
+	}
+	c.sentAt = time.Now()
+
+	return s.send(seq, data)
+}
+
+// OnAck applies a cumulative ACK and its SACK bitmap. Bit i of the bitmap
+// stands for chunk cumulative+1+i.
+func (s *ChunkSender) OnAck(cumulative uint32, sack []byte) error {
+	if cumulative > s.next {
+		return nil
+	}
+
+	// Замер RTT берем по самому свежему чанку, подтвержденному этим ACK
+	var newest *inflightChunk
+	newlyAcked := 0
+
+	for s.base < cumulative {
+		if c, ok := s.inflight[s.base]; ok {
+			if !c.acked {
+				newlyAcked++
+			}
+			newest = s.noteReceived(c, newest)
+			delete(s.inflight, s.base)
+		}
+		s.base++
+	}
+
+	for i := 0; i < len(sack)*8; i++ {
+		if sack[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		if c, ok := s.inflight[cumulative+1+uint32(i)]; ok && !c.acked {
+			c.acked = true
+			newlyAcked++
+			newest = s.noteReceived(c, newest)
+		}
+	}
+
+	s.unacked -= newlyAcked
+	s.window.acked(newlyAcked)
+
+	// Karn: по повторно отправленному чанку нельзя понять, на какую копию пришел ACK
+	if newest != nil && !newest.retransmitted {
+		s.rtt.Sample(time.Since(newest.sentAt))
+	}
+
+	return s.retransmitHoles()
+}
+
+func (s *ChunkSender) noteReceived(c, newest *inflightChunk) *inflightChunk {
+	if c.sentAt.After(s.newestAcked) {
+		s.newestAcked = c.sentAt
+	}
+	if newest == nil || c.sentAt.After(newest.sentAt) {
+		return c
+	}
+	return newest
+}
+
+// retransmitHoles resends missing chunks that enough later chunks have overtaken
+func (s *ChunkSender) retransmitHoles() error {
+	ackedAbove := 0
+	lostBefore := s.newestAcked.Add(-s.rtt.reorderWindow())
+	for seq := s.next; seq > s.base; seq-- {
+		c, ok := s.inflight[seq-1]
+		if !ok {
+			continue
+		}
+		if c.acked {
+			ackedAbove++
+			continue
+		}
+		// Повторно отправленный чанк ждет, пока не придет что-то отправленное после него
+		if ackedAbove >= DupAckThreshold && c.sentAt.Before(lostBefore) {
+			s.window.lost(seq-1, s.next)
+			if err := s.transmit(seq - 1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RetransmitExpired resends chunks that were not acknowledged within the
+// current retransmission timeout and backs the timeout off if there were any
+func (s *ChunkSender) RetransmitExpired() (int, error) {
+	rto := s.rtt.Timeout()
+	expired := 0
+	for seq := s.base; seq < s.next; seq++ {
+		c, ok := s.inflight[seq]
+		if !ok || c.acked || time.Since(c.sentAt) < rto {
+			continue
+		}
+		if expired == 0 {
+			s.window.timedOut(s.unacked, s.next)
+		}
+		if err := s.transmit(seq); err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	if expired > 0 {
+		s.rtt.Expired()
+	}
+	return expired, nil
+}
+
+// NextTimeout returns how long to wait for ACKs before the oldest chunk expires
+func (s *ChunkSender) NextTimeout() time.Duration {
+	rto := s.rtt.Timeout()
+	wait := rto
+	for seq := s.base; seq < s.next; seq++ {
+		c, ok := s.inflight[seq]
+		if !ok || c.acked {
+			continue
+		}
+		if left := rto - time.Since(c.sentAt); left < wait {
+			wait = left
+		}
+	}
+	return max(wait, time.Millisecond)
+}
+
+// ReadChunk reads chunk seq of a transfer that covers size bytes of the
+// file starting at base
+func ReadChunk(file io.ReaderAt, base, size int64, seq uint32) ([]byte, error) {
+	start := int64(seq) * ChunkSize
+	data := make([]byte, min(ChunkSize, size-start))
+	if _, err := file.ReadAt(data, base+start); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
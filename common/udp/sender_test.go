@@ -0,0 +1,125 @@
+package udp
+
+import (
+	"testing"
+	"time"
+)
+
+// testSender sends numChunks chunks into sent, counting transmissions per chunk
+func testSender(numChunks uint32) (*ChunkSender, map[uint32]int) {
+	sent := make(map[uint32]int)
+	s := NewChunkSender(numChunks, NewCongestionWindow(SlidingWindow, MaxWindow), NewRttEstimator(time.Second),
+		func(seq uint32) ([]byte, error) { return []byte{byte(seq)}, nil },
+		func(seq uint32, data []byte) error {
+			sent[seq]++
+			return nil
+		})
+	return s, sent
+}
+
+// sack builds a bitmap acknowledging the given chunks past cumulative
+func sack(cumulative uint32, seqs ...uint32) []byte {
+	bitmap := make([]byte, SackBitmapSize)
+	used := 0
+	for _, seq := range seqs {
+		i := int(seq - cumulative - 1)
+		bitmap[i/8] |= 1 << (i % 8)
+		used = max(used, i/8+1)
+	}
+	return bitmap[:used]
+}
+
+func TestChunkSenderWindow(t *testing.T) {
+	s, sent := testSender(100)
+	if err := s.Fill(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != SlidingWindow || s.next != SlidingWindow {
+		t.Fatalf("sent %d chunks, want the initial window of %d", len(sent), SlidingWindow)
+	}
+
+	if err := s.OnAck(4, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.base != 4 || len(s.inflight) != SlidingWindow-4 {
+		t.Errorf("after ACK 4: base %d, %d in flight", s.base, len(s.inflight))
+	}
+	// Медленный старт: окно растет на каждый подтвержденный чанк
+	if s.window.Size() != SlidingWindow+4 {
+		t.Errorf("window %d, want %d", s.window.Size(), SlidingWindow+4)
+	}
+}
+
+func TestChunkSenderSackRetransmitsHole(t *testing.T) {
+	s, sent := testSender(8)
+	if err := s.Fill(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Чанк 0 ушел заметно раньше тех, что дошли после него
+	now := time.Now()
+	for seq, c := range s.inflight {
+		c.sentAt = now.Add(time.Duration(seq) * time.Millisecond)
+	}
+	s.inflight[0].sentAt = now.Add(-time.Second)
+
+	if err := s.OnAck(0, sack(0, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if sent[0] != 1 {
+		t.Fatal("hole resent before enough chunks overtook it")
+	}
+
+	if err := s.OnAck(0, sack(0, 1, 2, 3, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if sent[0] != 2 || s.retransmits != 1 {
+		t.Fatalf("chunk 0 sent %d times, %d retransmits; want 2 and 1", sent[0], s.retransmits)
+	}
+	// Чанк 4 тоже не дошел, но его обогнал только чанк 5
+	if sent[4] != 1 {
+		t.Errorf("chunk 4 resent after one later chunk arrived")
+	}
+	if s.unacked != 4 {
+		t.Errorf("%d chunks unacknowledged, want 4", s.unacked)
+	}
+
+	// Полученные выборочно чанки не повторяются по таймеру
+	for _, c := range s.inflight {
+		c.sentAt = now.Add(-time.Hour)
+	}
+	expired, err := s.RetransmitExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 4 || sent[1] != 1 || sent[2] != 1 || sent[3] != 1 || sent[5] != 1 {
+		t.Errorf("timer resent %d chunks, transmissions %v", expired, sent)
+	}
+
+	if err := s.OnAck(8, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Done() || len(s.inflight) != 0 || s.unacked != 0 {
+		t.Errorf("after the final ACK: done %v, %d in flight, %d unacked", s.Done(), len(s.inflight), s.unacked)
+	}
+}
+
+func TestChunkSenderIgnoresAckAhead(t *testing.T) {
+	s, _ := testSender(20)
+	s.Fill()
+	if err := s.OnAck(SlidingWindow+1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.base != 0 {
+		t.Errorf("ACK for chunks never sent moved base to %d", s.base)
+	}
+}
+
+func TestChunkSenderStaysInsideSackRange(t *testing.T) {
+	s, _ := testSender(SackBitmapSize*8 + 100)
+	s.window = NewCongestionWindow(MaxWindow*4, MaxWindow*4)
+	s.Fill()
+	if s.next-s.base > SackBitmapSize*8 {
+		t.Errorf("%d chunks sent past base, the SACK bitmap covers %d", s.next-s.base, SackBitmapSize*8)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Стратегии выбора сервера из пула -backends
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyLeastConn  = "least-conn"
+	StrategyWeighted   = "weighted"
+)
+
+const BackendDialTimeout = 3 * time.Second
+
+var errNoBackends = errors.New("no backend available")
+
+// Сервер из пула. Счетчик клиентов ведет прокси, поэтому пул работает
+// только в режиме proxy
+type backendServer struct {
+	addr    string
+	weight  int
+	active  int // Клиенты, которых сейчас обслуживает прокси
+	current int // Текущий вес плавного weighted round-robin
+	health  healthState
+}
+
+var (
+	backends    []*backendServer
+	nextBackend int // Следующий кандидат round-robin
+)
+
+// Разбирает список host:port[=weight] через запятую
+func parseBackends(list string) ([]*backendServer, error) {
+	var pool []*backendServer
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		addr, weightText, hasWeight := strings.Cut(item, "=")
+		weight := 1
+		if hasWeight {
+			var err error
+			if weight, err = strconv.Atoi(weightText); err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", item)
+			}
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid backend address %q: %v", addr, err)
+		}
+		pool = append(pool, &backendServer{addr: addr, weight: weight})
+	}
+
+	if len(pool) == 0 {
+		return nil, errNoBackends
+	}
+	return pool, nil
+}
+
+func validStrategy(name string) bool {
+	return name == StrategyRoundRobin || name == StrategyLeastConn || name == StrategyWeighted
+}
+
+// Выбирает сервер по стратегии, пропуская уже опробованные и исключенные
+// проверками здоровья. Вызывается под mu
+func pickBackend(tried map[*backendServer]bool) *backendServer {
+	var candidates []*backendServer
+	for i := range backends {
+		// Обходим пул начиная с nextBackend, чтобы равные кандидаты чередовались
+		b := backends[(nextBackend+i)%len(backends)]
+		if !tried[b] && !b.health.unhealthy {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var chosen *backendServer
+	switch *strategyFlag {
+	case StrategyLeastConn:
+		for _, b := range candidates {
+			if chosen == nil || b.active < chosen.active {
+				chosen = b
+			}
+		}
+
+	case StrategyWeighted:
+		// Плавный weighted round-robin: веса накапливаются, выбранный
+		// сервер отдает сумму весов, так тяжелые не идут подряд
+		total := 0
+		for _, b := range candidates {
+			b.current += b.weight
+			total += b.weight
+			if chosen == nil || b.current > chosen.current {
+				chosen = b
+			}
+		}
+		chosen.current -= total
+
+	default:
+		chosen = candidates[0]
+	}
+
+	for i, b := range backends {
+		if b == chosen {
+			nextBackend = (i + 1) % len(backends)
+		}
+	}
+	chosen.active++
+	return chosen
+}
+
+// Пересылает клиента на сервер из пула. Если сервер не отвечает,
+// пробуем следующий, пока пул не закончится
+func proxyToBackend(conn net.Conn, clientIP string) {
+	tried := make(map[*backendServer]bool)
+	for {
+		mu.Lock()
+		b := pickBackend(tried)
+		mu.Unlock()
+		if b == nil {
+			log.Printf("No backend available for client %s", clientIP)
+			conn.Close()
+			return
+		}
+		tried[b] = true
+
+		backend, err := net.DialTimeout("tcp", b.addr, BackendDialTimeout)
+		if err != nil {
+			log.Printf("Backend %s is not responding: %v", b.addr, err)
+			releaseBackend(b)
+			continue
+		}
+
+		log.Printf("Proxying client %s to backend %s (%s)\n", clientIP, b.addr, *strategyFlag)
+		proxyConnection(conn, backend)
+		releaseBackend(b)
+		log.Printf("Proxy for client %s to backend %s closed\n", clientIP, b.addr)
+		return
+	}
+}
+
+func releaseBackend(b *backendServer) {
+	mu.Lock()
+	b.active--
+	mu.Unlock()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withBackends replaces the backend pool and the strategy for one test
+func withBackends(t *testing.T, strategy string, pool ...*backendServer) {
+	t.Helper()
+	oldPool, oldNext, oldStrategy := backends, nextBackend, *strategyFlag
+	backends, nextBackend, *strategyFlag = pool, 0, strategy
+	t.Cleanup(func() { backends, nextBackend, *strategyFlag = oldPool, oldNext, oldStrategy })
+}
+
+// picks returns the addresses of n consecutive picks, "-" when nothing was picked
+func picks(n int, tried map[*backendServer]bool, release bool) string {
+	var order []string
+	for i := 0; i < n; i++ {
+		b := pickBackend(tried)
+		if b == nil {
+			order = append(order, "-")
+			continue
+		}
+		order = append(order, b.addr)
+		if release {
+			b.active--
+		}
+	}
+	return strings.Join(order, " ")
+}
+
+func TestPickBackend(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		pool     []*backendServer
+		tried    []int // Индексы уже опробованных серверов
+		release  bool  // Клиент уходит до следующего выбора
+		n        int
+		want     string
+	}{
+		{
+			name:     "round-robin",
+			strategy: StrategyRoundRobin,
+			pool:     []*backendServer{{addr: "a", weight: 1}, {addr: "b", weight: 1}, {addr: "c", weight: 1}},
+			n:        5,
+			want:     "a b c a b",
+		},
+		{
+			name:     "round-robin skips unhealthy",
+			strategy: StrategyRoundRobin,
+			pool:     []*backendServer{{addr: "a", weight: 1}, {addr: "b", weight: 1, health: healthState{unhealthy: true}}, {addr: "c", weight: 1}},
+			n:        4,
+			want:     "a c a c",
+		},
+		{
+			name:     "round-robin skips tried",
+			strategy: StrategyRoundRobin,
+			pool:     []*backendServer{{addr: "a", weight: 1}, {addr: "b", weight: 1}, {addr: "c", weight: 1}},
+			tried:    []int{0},
+			n:        4,
+			want:     "b c b c",
+		},
+		{
+			name:     "least-conn",
+			strategy: StrategyLeastConn,
+			pool:     []*backendServer{{addr: "a", weight: 1, active: 2}, {addr: "b", weight: 1}, {addr: "c", weight: 1, active: 1}},
+			n:        4,
+			want:     "b c b c",
+		},
+		{
+			name:     "least-conn alternates equal servers",
+			strategy: StrategyLeastConn,
+			pool:     []*backendServer{{addr: "a", weight: 1}, {addr: "b", weight: 1}},
+			release:  true,
+			n:        4,
+			want:     "a b a b",
+		},
+		{
+			name:     "smooth weighted",
+			strategy: StrategyWeighted,
+			pool:     []*backendServer{{addr: "a", weight: 5}, {addr: "b", weight: 1}, {addr: "c", weight: 1}},
+			n:        7,
+			want:     "a a b a c a a",
+		},
+		{
+			name:     "weighted skips unhealthy",
+			strategy: StrategyWeighted,
+			pool:     []*backendServer{{addr: "a", weight: 2, health: healthState{unhealthy: true}}, {addr: "b", weight: 1}},
+			n:        3,
+			want:     "b b b",
+		},
+		{
+			name:     "nothing left",
+			strategy: StrategyRoundRobin,
+			pool:     []*backendServer{{addr: "a", weight: 1}, {addr: "b", weight: 1, health: healthState{unhealthy: true}}},
+			tried:    []int{0},
+			n:        1,
+			want:     "-",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withBackends(t, tt.strategy, tt.pool...)
+			tried := make(map[*backendServer]bool)
+			for _, i := range tt.tried {
+				tried[tt.pool[i]] = true
+			}
+			if got := picks(tt.n, tried, tt.release); got != tt.want {
+				t.Errorf("picks = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickBackendWeightRatio(t *testing.T) {
+	a := &backendServer{addr: "a", weight: 3}
+	b := &backendServer{addr: "b", weight: 2}
+	withBackends(t, StrategyWeighted, a, b)
+
+	counts := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		counts[pickBackend(nil).addr]++
+	}
+	if counts["a"] != 30 || counts["b"] != 20 {
+		t.Errorf("50 picks with weights 3:2 = %v, want a:30 b:20", counts)
+	}
+	if a.active != 30 || b.active != 20 {
+		t.Errorf("active = %d, %d; want 30, 20", a.active, b.active)
+	}
+}
+
+func TestParseBackends(t *testing.T) {
+	pool, err := parseBackends("10.0.0.1:8081, 10.0.0.2:8081=3,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool) != 2 || pool[0].weight != 1 || pool[1].addr != "10.0.0.2:8081" || pool[1].weight != 3 {
+		t.Errorf("parseBackends = %+v, %+v", *pool[0], *pool[1])
+	}
+
+	for _, list := range []string{"", " , ", "10.0.0.1", "10.0.0.1:8081=0", "10.0.0.1:8081=x"} {
+		if _, err := parseBackends(list); err == nil {
+			t.Errorf("parseBackends(%q) was accepted", list)
+		}
+	}
+}
@@ -1,3 +1,7 @@
 module lg-gt
 
 go 1.24.1
+
+require common v0.0.0
+
+replace common => ../common
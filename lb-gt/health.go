@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"common/storage"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Виды проверки здоровья: только TCP соединение или еще и команда TIME
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckTime = "time"
+)
+
+const (
+	HealthTimeout  = 2 * time.Second
+	HealthMaxLines = 3 // Строк, среди которых ждем ответ на TIME: перед ним может прийти приветствие
+)
+
+var errBadHealthReply = errors.New("unexpected reply to TIME")
+
+// Состояние проверок одного сервера. Сервер исключается после
+// healthFails неудач подряд и возвращается после healthPasses успехов подряд
+type healthState struct {
+	unhealthy bool
+	fails     int
+	passes    int
+}
+
+// Учитывает результат проверки, возвращает true, если состояние сменилось
+func (h *healthState) record(err error) bool {
+	if err != nil {
+		h.passes = 0
+		h.fails++
+		if !h.unhealthy && h.fails >= *healthFailsFlag {
+			h.unhealthy = true
+			return true
+		}
+		return false
+	}
+
+	h.fails = 0
+	if h.unhealthy {
+		h.passes++
+		if h.passes >= *healthPassesFlag {
+			h.unhealthy = false
+			h.passes = 0
+			return true
+		}
+	}
+	return false
+}
+
+// Отправляет TIME и ждет в ответе время. Отказ из-за отсутствия LOGIN
+// тоже означает, что сервер жив и разбирает команды
+func probeTime(conn net.Conn, reader *bufio.Reader) error {
+	conn.SetDeadline(time.Now().Add(HealthTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "TIME\n"); err != nil {
+		return err
+	}
+	for i := 0; i < HealthMaxLines; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if healthyReply(line) {
+			return nil
+		}
+	}
+	return errBadHealthReply
+}
+
+func healthyReply(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	if _, err := time.Parse(time.RFC3339, fields[len(fields)-1]); err == nil {
+		return true
+	}
+	return strings.HasPrefix(line, "Command failed: "+storage.ErrLoginRequired.Error())
+}
+
+// Проверяет сервер из пула новым соединением
+func probeBackend(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, HealthTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if *healthCheckFlag == HealthCheckTCP {
+		return nil
+	}
+	return probeTime(conn, bufio.NewReader(conn))
+}
+
+// Периодически проверяет все серверы пула, исключенные тоже: так
+// замечаем, что они восстановились
+func checkBackends() {
+	ticker := time.NewTicker(*healthIntervalFlag)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		errs := make([]error, len(backends))
+		var wg sync.WaitGroup
+		for i, b := range backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = probeBackend(b.addr)
+			}()
+		}
+		wg.Wait()
+
+		mu.Lock()
+		for i, b := range backends {
+			if !b.health.record(errs[i]) {
+				continue
+			}
+			if b.health.unhealthy {
+				log.Printf("Backend %s failed %d health checks (%v), removed from rotation", b.addr, b.health.fails, errs[i])
+			} else {
+				log.Printf("Backend %s passed %d health checks, back in rotation", b.addr, *healthPassesFlag)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// Проверяет дочерний сервер через управляющее соединение родителя, пока
+// процесс не завершится. Новое соединение заняло бы место клиента.
+// Зависший дочерний сервер останавливается
+func checkChild(child *childServer) {
+	ticker := time.NewTicker(*healthIntervalFlag)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-child.exited:
+			return
+		case <-ticker.C:
+		}
+
+		err := probeTime(child.control, child.controlReader)
+		select {
+		case <-child.exited:
+			// Процесс завершился во время проверки, это не сбой
+			return
+		default:
+		}
+
+		mu.Lock()
+		changed := child.health.record(err)
+		mu.Unlock()
+		if changed {
+			log.Printf("Child server on port %d failed %d health checks (%v), stopping it", child.port, child.health.fails, err)
+			child.cmd.Process.Kill()
+			return
+		}
+	}
+}
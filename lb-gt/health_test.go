@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHealthStateRecord(t *testing.T) {
+	oldFails, oldPasses := *healthFailsFlag, *healthPassesFlag
+	*healthFailsFlag, *healthPassesFlag = 3, 2
+	t.Cleanup(func() { *healthFailsFlag, *healthPassesFlag = oldFails, oldPasses })
+
+	fail := errors.New("no answer")
+	steps := []struct {
+		err       error
+		changed   bool
+		unhealthy bool
+	}{
+		{fail, false, false},
+		{fail, false, false},
+		{nil, false, false}, // Успех обнуляет счетчик неудач
+		{fail, false, false},
+		{fail, false, false},
+		{fail, true, true}, // Третья неудача подряд исключает сервер
+		{fail, false, true},
+		{nil, false, true},
+		{fail, false, true}, // Неудача обнуляет счетчик успехов
+		{nil, false, true},
+		{nil, true, false}, // Второй успех подряд возвращает сервер
+		{nil, false, false},
+	}
+
+	var h healthState
+	for i, step := range steps {
+		if changed := h.record(step.err); changed != step.changed || h.unhealthy != step.unhealthy {
+			t.Fatalf("step %d: record(%v) = %v, unhealthy %v; want %v, %v",
+				i+1, step.err, changed, h.unhealthy, step.changed, step.unhealthy)
+		}
+	}
+}
@@ -2,6 +2,14 @@ package main
 
 import (
 	"bufio"
+	"common/storage"
+	"common/tlsconfig"
+	"common/transfer"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -15,10 +23,18 @@ import (
 	"time"
 )
 
+// Способы передать клиента дочернему серверу
+const (
+	ModeRedirect = "redirect" // Клиент получает REDIRECT и переподключается сам
+	ModeProxy    = "proxy"    // Основной сервер пересылает байты, клиенту нужен один порт
+)
+
 const (
 	MainServerPort  = 8081
 	KeepAlivePeriod = 30 * time.Second
 	StartupTimeout  = 5 * time.Second
+	HandoffTimeout  = 30 * time.Second // Сколько дочерний сервер ждет клиента после REDIRECT
+	ChildTokenEnv   = "LB_CHILD_TOKEN" // Случайный токен, которым дочерний сервер приветствует родителя
 )
 
 // Информация о запущенном процессе-сервере
@@ -26,11 +42,40 @@ type childServer struct {
 	cmd      *exec.Cmd
 	port     int
 	clientIP string
+
+	// Первое соединение родителя остается открытым, по нему идут проверки здоровья
+	control       net.Conn
+	controlReader *bufio.Reader
+	health        healthState
+	exited        chan struct{} // Закрывается, когда процесс завершился
 }
 
+var (
+	storageRootFlag    = flag.String("root", ".", "directory that holds uploaded and downloadable files")
+	modeFlag           = flag.String("mode", ModeRedirect, "how clients reach their child server: redirect or proxy")
+	backendsFlag       = flag.String("backends", "", "comma separated host:port[=weight] servers to balance across instead of starting child servers, requires -mode proxy")
+	strategyFlag       = flag.String("strategy", StrategyRoundRobin, "backend selection: round-robin, least-conn or weighted")
+	portsFlag          = flag.String("ports", fmt.Sprintf("%d-%d", firstPort, lastPort), "first-last range of ports for child servers, a port is reused once its child server exits")
+	poolMinFlag        = flag.Int("pool-min", 2, "idle child servers kept ready for new clients")
+	poolMaxFlag        = flag.Int("pool-max", 8, "idle child servers the pool grows to when clients find it empty, 0 starts a child server per client")
+	healthIntervalFlag = flag.Duration("health-interval", 5*time.Second, "period of health checks of backends and child servers, 0 disables them")
+	healthFailsFlag    = flag.Int("health-fails", 3, "failed health checks in a row that eject a backend or stop a child server")
+	healthPassesFlag   = flag.Int("health-passes", 2, "passed health checks in a row that bring an ejected backend back")
+	healthCheckFlag    = flag.String("health-check", HealthCheckTime, "backend health check: time sends TIME and expects the time, tcp only connects (use it for TLS backends)")
+	redirectHost       = flag.String("redirect-host", "", "host sent in REDIRECT replies, clients reuse the host they dialed when empty")
+	tlsCertFlag        = flag.String("tls-cert", "", "PEM certificate for client connections, enables TLS")
+	tlsKeyFlag         = flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsClientCAFlag    = flag.String("tls-client-ca", "", "PEM CA bundle, clients must present a certificate signed by it")
+	usersFlag          = flag.String("users", "", "file with user accounts, clients must then LOGIN and are confined to the directory of their role")
+	addUserFlag        = flag.String("add-user", "", "add this user to the -users file with a password read from stdin and exit")
+	roleFlag           = flag.String("role", storage.RoleGuest, "role of the user added with -add-user: guest, ingest or admin")
+)
+
+// tlsConfig is nil when clients connect in plaintext
+var tlsConfig *tls.Config
+
 var (
 	childServers = make(map[int]*childServer)
-	nextPort     = MainServerPort + 1
 	mu           sync.Mutex
 )
 
@@ -38,6 +83,11 @@ func main() {
 	// Настройка логгера для включения микросекунд
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
+	// Ограничения хранилища нужны и основному, и дочерним серверам
+	flag.Var(storage.SizeValue(&storage.MaxFileSize), "max-file-size", "largest file a client may upload, e.g. 100M, 0 for unlimited")
+	flag.Var(storage.SizeValue(&storage.GlobalQuota), "quota", "total size of all stored files, e.g. 10G, 0 for unlimited")
+	flag.Var(storage.SizeValue(&storage.DefaultUserQuota), "user-quota", "size of the files under the root of each account unless the users file sets a quota, 0 for unlimited")
+
 	// Определяем, является ли это процесс дочерним сервером
 	if len(os.Args) > 1 && os.Args[1] == "child" {
 		if len(os.Args) < 3 {
@@ -47,10 +97,85 @@ func main() {
 		if err != nil {
 			log.Fatalf("Invalid port for child server: %s", os.Args[2])
 		}
+		flag.CommandLine.Parse(os.Args[3:])
+		if err := storage.SetRoot(*storageRootFlag); err != nil {
+			log.Fatalf("Storage error: %v", err)
+		}
+		if tlsConfig, err = tlsconfig.Server(*tlsCertFlag, *tlsKeyFlag, *tlsClientCAFlag); err != nil {
+			log.Fatalf("TLS error: %v", err)
+		}
+		if *usersFlag != "" {
+			if err := storage.LoadUsers(*usersFlag); err != nil {
+				log.Fatalf("Users error: %v", err)
+			}
+		}
 		handleChildServer(port)
 		return
 	}
 
+	flag.Parse()
+	if *addUserFlag != "" {
+		if err := addUserFromStdin(*usersFlag, *addUserFlag, *roleFlag); err != nil {
+			log.Fatalf("Could not add user: %v", err)
+		}
+		log.Printf("Added %s %s to %s\n", *roleFlag, *addUserFlag, *usersFlag)
+		return
+	}
+
+	if err := storage.SetRoot(*storageRootFlag); err != nil {
+		log.Fatalf("Storage error: %v", err)
+	}
+	log.Printf("Serving files from %s\n", storage.Root)
+
+	if *modeFlag != ModeRedirect && *modeFlag != ModeProxy {
+		log.Fatalf("Unknown mode %q, use %s or %s", *modeFlag, ModeRedirect, ModeProxy)
+	}
+
+	var err error
+	if *backendsFlag != "" {
+		// При REDIRECT неизвестно, когда клиент ушел, а счетчики нужны стратегиям
+		if *modeFlag != ModeProxy {
+			log.Fatalf("-backends requires -mode %s", ModeProxy)
+		}
+		if !validStrategy(*strategyFlag) {
+			log.Fatalf("Unknown strategy %q, use %s, %s or %s", *strategyFlag, StrategyRoundRobin, StrategyLeastConn, StrategyWeighted)
+		}
+		if backends, err = parseBackends(*backendsFlag); err != nil {
+			log.Fatalf("Backends error: %v", err)
+		}
+		log.Printf("Balancing across %d backends (%s)\n", len(backends), *strategyFlag)
+	}
+	if *healthCheckFlag != HealthCheckTime && *healthCheckFlag != HealthCheckTCP {
+		log.Fatalf("Unknown health check %q, use %s or %s", *healthCheckFlag, HealthCheckTime, HealthCheckTCP)
+	}
+	if len(backends) > 0 && *healthIntervalFlag > 0 {
+		go checkBackends()
+	}
+
+	if tlsConfig, err = tlsconfig.Server(*tlsCertFlag, *tlsKeyFlag, *tlsClientCAFlag); err != nil {
+		log.Fatalf("TLS error: %v", err)
+	}
+
+	// Файл проверяем сразу, дочерние серверы загрузят его сами
+	if *usersFlag != "" {
+		if err := storage.LoadUsers(*usersFlag); err != nil {
+			log.Fatalf("Users error: %v", err)
+		}
+		log.Printf("Loaded %d user accounts, clients must log in\n", len(storage.Users))
+	}
+
+	if firstPort, lastPort, err = parsePortRange(*portsFlag); err != nil {
+		log.Fatalf("Ports error: %v", err)
+	}
+	nextPort = firstPort
+	if *poolMinFlag < 0 || *poolMaxFlag < *poolMinFlag {
+		log.Fatalf("Invalid pool size, need 0 <= -pool-min <= -pool-max")
+	}
+	// Дочерние серверы из запаса получают уже разобранные TLS и пользователей
+	if len(backends) == 0 && *poolMaxFlag > 0 {
+		go refillPool()
+	}
+
 	// Основной сервер
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", MainServerPort))
 	if err != nil {
@@ -58,7 +183,7 @@ func main() {
 	}
 	defer ln.Close()
 
-	log.Printf("Main TCP server listening on :%d\n", MainServerPort)
+	log.Printf("Main TCP server listening on :%d (%s mode)\n", MainServerPort, *modeFlag)
 
 	// Главный цикл принятия соединений
 	for {
@@ -75,127 +200,283 @@ func main() {
 		clientIP := conn.RemoteAddr().String()
 		log.Printf("New TCP connection from %s\n", clientIP)
 
+		// Клиент получит REDIRECT уже по защищенному соединению.
+		// В режиме прокси TLS завершает дочерний сервер, байты идут насквозь
+		if tlsConfig != nil && *modeFlag == ModeRedirect {
+			conn = tls.Server(conn, tlsConfig)
+		}
+
 		// Запускаем дочерний сервер и перенаправляем клиента
-		go handleNewClient(tcpConn, clientIP)
+		go handleNewClient(conn, clientIP)
 	}
 }
 
 func handleNewClient(conn net.Conn, clientIP string) {
-	// НЕ закрываем соединение сразу, чтобы дать время клиенту переподключиться
-	// defer conn.Close()
+	// С пулом серверов дочерние процессы не запускаются
+	if len(backends) > 0 {
+		proxyToBackend(conn, clientIP)
+		return
+	}
+
+	// Берем готовый сервер из запаса, если запас пуст, запускаем новый
+	var child *childServer
+	if *poolMaxFlag > 0 {
+		child = takeChild()
+	}
+	if child == nil {
+		var err error
+		if child, err = startChild(); err != nil {
+			log.Printf("Failed to start child server: %v", err)
+			conn.Close()
+			return
+		}
+	}
+	childPort := child.port
 
-	// Выбираем порт для дочернего сервера
 	mu.Lock()
-	childPort := nextPort
-	nextPort++
+	child.clientIP = clientIP
 	mu.Unlock()
 
-	// Получаем полный путь к текущему исполняемому файлу
-	execPath, err := os.Executable()
-	if err != nil {
-		log.Printf("Failed to get executable path: %v", err)
-		conn.Close()
+	if *modeFlag == ModeProxy {
+		// Клиентское соединение дочерний сервер примет вторым, как и при REDIRECT
+		backend, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", childPort), StartupTimeout)
+		if err != nil {
+			log.Printf("Failed to connect to child server on port %d: %v", childPort, err)
+			child.cmd.Process.Kill()
+			conn.Close()
+			return
+		}
+		log.Printf("Proxying client %s to child server on port %d\n", clientIP, childPort)
+		proxyConnection(conn, backend)
+		log.Printf("Proxy for client %s closed\n", clientIP)
 		return
 	}
-	execPath, err = filepath.Abs(execPath)
-	if err != nil {
-		log.Printf("Failed to get absolute path: %v", err)
+
+	// Клиент может не переподключиться, тогда сервер не должен ждать его вечно
+	if _, err := fmt.Fprintf(child.control, "HANDOFF\n"); err != nil {
+		log.Printf("Failed to hand off child server on port %d: %v", childPort, err)
+		child.cmd.Process.Kill()
 		conn.Close()
 		return
 	}
 
+	log.Printf("Redirecting client %s to child server on port %d\n", clientIP, childPort)
+	var err error
+	if *redirectHost != "" {
+		_, err = fmt.Fprintf(conn, "REDIRECT %s\n", net.JoinHostPort(*redirectHost, strconv.Itoa(childPort)))
+	} else {
+		_, err = fmt.Fprintf(conn, "REDIRECT %d\n", childPort)
+	}
+	if err != nil {
+		log.Printf("Failed to send redirect to client: %v", err)
+		child.cmd.Process.Kill()
+	}
+
+	// Ответ уже отправлен, клиент сам закрывает соединение и переподключается
+	conn.Close()
+}
+
+// Запускает дочерний сервер на свободном порту. Если сервер завершился,
+// не начав слушать, пробуем другой порт
+func startChild() (*childServer, error) {
+	var err error
+	for attempt := 1; attempt <= ChildStartAttempts; attempt++ {
+		var port int
+		if port, err = allocatePort(); err != nil {
+			return nil, err
+		}
+
+		var child *childServer
+		if child, err = launchChild(port); err == nil {
+			return child, nil
+		}
+		if !errors.Is(err, errChildExited) && !errors.Is(err, errPortTaken) {
+			return nil, err
+		}
+		log.Printf("Child server on port %d failed to start (%v), attempt %d of %d", port, err, attempt, ChildStartAttempts)
+	}
+	return nil, err
+}
+
+// Запускает дочерний сервер на выделенном порту и ждет, пока он примет
+// управляющее соединение. Дальше за процессом следят checkChild и waitChild,
+// waitChild же освобождает порт
+func launchChild(childPort int) (*childServer, error) {
+	// Получаем полный путь к текущему исполняемому файлу
+	execPath, err := os.Executable()
+	if err == nil {
+		execPath, err = filepath.Abs(execPath)
+	}
+	if err != nil {
+		releasePort(childPort)
+		return nil, fmt.Errorf("failed to get executable path: %v", err)
+	}
+
+	// Токен знает только наш процесс, по нему отличаем ребенка от чужой
+	// программы, успевшей занять порт после portFree
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+
 	// Запускаем дочерний процесс сервера
-	cmd := exec.Command(execPath, "child", strconv.Itoa(childPort))
+	cmd := exec.Command(execPath, childArgs(childPort)...)
+	cmd.Env = append(os.Environ(), ChildTokenEnv+"="+token)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-
-	// Запускаем дочерний процесс
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start child server: %v", err)
-		conn.Close()
-		return
+		releasePort(childPort)
+		return nil, err
 	}
 
 	// Регистрируем дочерний сервер
 	child := &childServer{
-		cmd:      cmd,
-		port:     childPort,
-		clientIP: clientIP,
+		cmd:    cmd,
+		port:   childPort,
+		exited: make(chan struct{}),
 	}
 
 	mu.Lock()
 	childServers[childPort] = child
 	mu.Unlock()
+	go waitChild(child)
 
-	// Даем серверу время запуститься
+	// Ждем, пока сервер начнет принимать соединения. Процесс, который не
+	// смог занять порт, завершается сразу, его ждать незачем
 	log.Printf("Waiting for child server on port %d to start...", childPort)
-	time.Sleep(100 * time.Millisecond)
-
-	// Проверяем доступность порта без закрытия проверочного соединения
-	serverReady := false
 	var testConn net.Conn
+	for start := time.Now(); testConn == nil; {
+		select {
+		case <-child.exited:
+			return nil, errChildExited
+		default:
+		}
+		if time.Since(start) >= StartupTimeout {
+			cmd.Process.Kill()
+			return nil, fmt.Errorf("child server on port %d is not responding", childPort)
+		}
 
-	for start := time.Now(); time.Since(start) < StartupTimeout; {
 		testConn, err = net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", childPort), 100*time.Millisecond)
-		if err == nil {
-			// Получили соединение, но НЕ закрываем его
-			// Оставляем соединение открытым, чтобы дочерний сервер не завершил работу
-			log.Printf("Successfully connected to 127.0.0.1:%d", childPort)
-			serverReady = true
-			break
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
+	log.Printf("Successfully connected to 127.0.0.1:%d", childPort)
 
-	if !serverReady {
-		log.Printf("Child server on port %d is not responding", childPort)
+	reader := bufio.NewReader(testConn)
+	if err := verifyChild(testConn, reader, token); err != nil {
+		testConn.Close()
 		cmd.Process.Kill()
-		mu.Lock()
-		delete(childServers, childPort)
+		return nil, fmt.Errorf("%w: port %d: %v", errPortTaken, childPort, err)
+	}
+
+	// Проверочное соединение НЕ закрываем: оно становится управляющим до
+	// завершения процесса, без него дочерний сервер завершит работу
+	mu.Lock()
+	select {
+	case <-child.exited:
 		mu.Unlock()
-		conn.Close()
-		return
+		testConn.Close()
+		return nil, errChildExited
+	default:
 	}
+	child.control = testConn
+	child.controlReader = reader
+	mu.Unlock()
 
-	log.Printf("Redirecting client %s to child server on port %d\n", clientIP, childPort)
-	_, err = fmt.Fprintf(conn, "REDIRECT %d\n", childPort)
+	if *healthIntervalFlag > 0 {
+		go checkChild(child)
+	}
+	return child, nil
+}
+
+// Ждет приветствия, которое дочерний сервер первым шлет по управляющему
+// соединению. Чужая программа на порту не знает токена и проверку не пройдет
+func verifyChild(conn net.Conn, reader *bufio.Reader, token string) error {
+	conn.SetReadDeadline(time.Now().Add(HealthTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	line, err := reader.ReadString('\n')
 	if err != nil {
-		log.Printf("Failed to send redirect to client: %v", err)
-		if testConn != nil {
-			testConn.Close()
-		}
-		cmd.Process.Kill()
-		mu.Lock()
-		delete(childServers, childPort)
-		mu.Unlock()
-		conn.Close()
-		return
+		return err
 	}
+	if strings.TrimSpace(line) != "CHILD "+token {
+		return errors.New("unexpected greeting")
+	}
+	return nil
+}
 
-	// Даем клиенту время на переподключение
-	time.Sleep(1 * time.Second)
+// Снимает дочерний сервер с учета после завершения процесса и освобождает порт
+func waitChild(child *childServer) {
+	err := child.cmd.Wait()
 
-	// Теперь можно закрыть тестовое соединение
-	if testConn != nil {
-		log.Printf("Closing test connection to child server on port %d", childPort)
-		testConn.Close()
+	mu.Lock()
+	close(child.exited)
+	if child.control != nil {
+		child.control.Close()
 	}
+	delete(childServers, child.port)
+	delete(usedPorts, child.port)
+	removeIdleChild(child)
+	mu.Unlock()
+	wakePool()
 
-	// Закрываем соединение с клиентом
-	conn.Close()
+	if err != nil {
+		log.Printf("Child server on port %d terminated with error: %v", child.port, err)
+	} else {
+		log.Printf("Child server on port %d terminated normally", child.port)
+	}
+}
 
-	// Ждем завершения дочернего процесса
-	go func() {
-		err := cmd.Wait()
-		mu.Lock()
-		delete(childServers, childPort)
-		mu.Unlock()
-		if err != nil {
-			log.Printf("Child server on port %d terminated with error: %v", childPort, err)
+// Пересылает байты в обе стороны, пока обе стороны не закончат передачу.
+// Конец потока одной стороны передается другой как полузакрытие
+func proxyConnection(client, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcpConn, ok := dst.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
 		} else {
-			log.Printf("Child server on port %d terminated normally", childPort)
+			dst.Close()
 		}
-	}()
+		done <- struct{}{}
+	}
+
+	go pipe(backend, client)
+	go pipe(client, backend)
+	<-done
+	<-done
+	client.Close()
+	backend.Close()
+}
+
+// Аргументы запуска дочернего сервера: порт и настройки, унаследованные от основного
+func childArgs(port int) []string {
+	args := []string{"child", strconv.Itoa(port), "-root", storage.Root}
+	if tlsConfig != nil {
+		args = append(args, "-tls-cert", *tlsCertFlag, "-tls-key", *tlsKeyFlag, "-tls-client-ca", *tlsClientCAFlag)
+	}
+	if storage.Users != nil {
+		args = append(args, "-users", *usersFlag)
+	}
+	args = append(args,
+		"-max-file-size", strconv.FormatInt(storage.MaxFileSize, 10),
+		"-quota", strconv.FormatInt(storage.GlobalQuota, 10),
+		"-user-quota", strconv.FormatInt(storage.DefaultUserQuota, 10))
+	return args
+}
+
+// Пароль нового пользователя читается из первой строки stdin
+func addUserFromStdin(usersFile, name, role string) error {
+	if usersFile == "" {
+		return fmt.Errorf("-add-user requires -users")
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("could not read password: %v", err)
+	}
+	return storage.AddUser(usersFile, name, role, strings.TrimRight(password, "\r\n"))
 }
 
 func handleChildServer(port int) {
@@ -212,6 +493,10 @@ func handleChildServer(port int) {
 
 	for connCount < maxConn {
 		conn, err := ln.Accept()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("No client arrived at child server on port %d within %v", port, HandoffTimeout)
+			return
+		}
 		if err != nil {
 			log.Printf("Child server accept error: %v", err)
 			return
@@ -222,15 +507,14 @@ func handleChildServer(port int) {
 			port, connCount, maxConn, conn.RemoteAddr())
 
 		if connCount == 1 {
-			// Это тестовое соединение, держим его открытым
-			go func(c net.Conn) {
-				defer c.Close()
-				buffer := make([]byte, 1)
-				c.Read(buffer) // Блокируется до закрытия соединения
-				log.Printf("Test connection closed on port %d", port)
-			}(conn)
+			// Это управляющее соединение родителя, держим его открытым
+			go serveControl(conn, ln, port)
 		} else {
-			// Это клиентское соединение, обрабатываем его
+			// Это клиентское соединение, обрабатываем его.
+			// Тестовое соединение от родителя TLS не использует
+			if tlsConfig != nil {
+				conn = tls.Server(conn, tlsConfig)
+			}
 			handleClientConnection(conn)
 			log.Printf("Client disconnected from child server on port %d\n", port)
 			return // Завершаем работу сервера после обработки клиента
@@ -238,12 +522,41 @@ func handleChildServer(port int) {
 	}
 }
 
+// Отвечает родителю на проверки здоровья, пока он держит соединение.
+// Когда родитель закрыл его, сервер из запаса больше не ждет клиента.
+// HANDOFF означает, что клиент направлен к нам и должен прийти за HandoffTimeout
+func serveControl(conn net.Conn, ln net.Listener, port int) {
+	defer conn.Close()
+
+	// Родитель убеждается, что на порту именно мы
+	fmt.Fprintf(conn, "CHILD %s\n", os.Getenv(ChildTokenEnv))
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			log.Printf("Control connection closed on port %d", port)
+			ln.Close()
+			return
+		}
+		switch strings.ToUpper(strings.TrimSpace(line)) {
+		case "TIME":
+			fmt.Fprintf(conn, "%s\n", time.Now().Format(time.RFC3339))
+		case "HANDOFF":
+			ln.(*net.TCPListener).SetDeadline(time.Now().Add(HandoffTimeout))
+		}
+	}
+}
+
 func handleClientConnection(conn net.Conn) {
 	defer conn.Close()
 
 	// Отправляем приветственное сообщение
 	fmt.Fprintf(conn, "Hello from child server! You are connected.\n")
 
+	// Без файла пользователей клиент сразу работает в общем хранилище
+	acc := storage.AnonymousAccount()
+
 	reader := bufio.NewReader(conn)
 	for {
 		// Читаем команду от клиента
@@ -256,7 +569,6 @@ func handleClientConnection(conn net.Conn) {
 		}
 
 		message = strings.TrimSpace(message)
-		log.Printf("Received command: %s\n", message)
 
 		// Парсим команду
 		cmdParts := strings.Fields(message)
@@ -266,7 +578,24 @@ func handleClientConnection(conn net.Conn) {
 
 		cmd := strings.ToUpper(cmdParts[0])
 
+		// Пароль в лог не попадает
+		if cmd == "LOGIN" && len(cmdParts) > 1 {
+			log.Printf("Received command: LOGIN %s ***\n", cmdParts[1])
+		} else {
+			log.Printf("Received command: %s\n", message)
+		}
+
+		if err := storage.Authorize(acc, cmd); err != nil {
+			fmt.Fprintf(conn, "Command failed: %v\n", err)
+			continue
+		}
+
 		switch {
+		case cmd == "LOGIN":
+			// Пароль может содержать пробелы, поэтому берем остаток строки целиком
+			name, password, _ := strings.Cut(strings.TrimSpace(message[len(cmdParts[0]):]), " ")
+			acc = handleLogin(conn, acc, name, password)
+
 		case cmd == "ECHO" && len(cmdParts) > 1:
 			// Отправляем эхо-ответ
 			response := strings.Join(cmdParts[1:], " ")
@@ -284,12 +613,67 @@ func handleClientConnection(conn net.Conn) {
 				fmt.Fprintf(conn, "Upload failed: invalid file size\n")
 				continue
 			}
-			handleFileUpload(conn, reader, filename, fileSize)
+			if err := handleFileUpload(conn, reader, acc, filename, fileSize); err != nil {
+				log.Printf("Error receiving file: %v", err)
+				return
+			}
 
 		case cmd == "DOWNLOAD" && len(cmdParts) >= 2:
 			// Обрабатываем скачивание файла
 			filename := cmdParts[1]
-			handleFileDownload(conn, filename)
+			var offset int64
+			if len(cmdParts) >= 3 {
+				offset, _ = strconv.ParseInt(cmdParts[2], 10, 64)
+			}
+			if err := handleFileDownload(conn, reader, acc.Root(), filename, offset); err != nil {
+				log.Printf("Error sending file: %v", err)
+				return
+			}
+
+		case cmd == "LIST":
+			// Выводим содержимое каталога, список завершается строкой END
+			dir := "."
+			if len(cmdParts) > 1 {
+				dir = cmdParts[1]
+			}
+			lines, err := storage.List(acc.Root(), dir)
+			if err != nil {
+				fmt.Fprintf(conn, "List failed: %s: %v\n", dir, err)
+				continue
+			}
+			for _, line := range lines {
+				fmt.Fprintf(conn, "%s\n", line)
+			}
+			fmt.Fprintf(conn, "END\n")
+
+		case cmd == "STAT" && len(cmdParts) >= 2:
+			line, err := storage.Stat(acc.Root(), cmdParts[1])
+			if err != nil {
+				fmt.Fprintf(conn, "Stat failed: %s: %v\n", cmdParts[1], err)
+				continue
+			}
+			fmt.Fprintf(conn, "%s\n", line)
+
+		case cmd == "DELETE" && len(cmdParts) >= 2:
+			if err := storage.Delete(acc.Root(), cmdParts[1]); err != nil {
+				fmt.Fprintf(conn, "Delete failed: %s: %v\n", cmdParts[1], err)
+				continue
+			}
+			fmt.Fprintf(conn, "Deleted '%s'\n", cmdParts[1])
+
+		case cmd == "RENAME" && len(cmdParts) >= 3:
+			if err := storage.Rename(acc.Root(), cmdParts[1], cmdParts[2]); err != nil {
+				fmt.Fprintf(conn, "Rename failed: %s: %v\n", cmdParts[1], err)
+				continue
+			}
+			fmt.Fprintf(conn, "Renamed '%s' to '%s'\n", cmdParts[1], cmdParts[2])
+
+		case cmd == "MKDIR" && len(cmdParts) >= 2:
+			if err := storage.MakeDir(acc.Root(), cmdParts[1]); err != nil {
+				fmt.Fprintf(conn, "Mkdir failed: %s: %v\n", cmdParts[1], err)
+				continue
+			}
+			fmt.Fprintf(conn, "Created directory '%s'\n", cmdParts[1])
 
 		default:
 			// Неизвестная команда
@@ -298,100 +682,165 @@ func handleClientConnection(conn net.Conn) {
 	}
 }
 
+// Вход под учетной записью, при неудаче остается прежняя
+func handleLogin(conn net.Conn, current *storage.Account, name, password string) *storage.Account {
+	if storage.Users == nil {
+		fmt.Fprintf(conn, "Login not required, the server accepts anonymous clients\n")
+		return current
+	}
+
+	acc, err := storage.Login(name, password)
+	if err != nil {
+		log.Printf("Failed login as '%s'", name)
+		fmt.Fprintf(conn, "Login failed: %v\n", err)
+		return current
+	}
+	fmt.Fprintf(conn, "Logged in as %s\n", acc.Name())
+	return acc
+}
+
 // Обработка загрузки файла от клиента
-func handleFileUpload(conn net.Conn, reader *bufio.Reader, filename string, fileSize int64) {
-	// Отправляем подтверждение готовности принять файл
-	fmt.Fprintf(conn, "Ready to receive file '%s' (%d bytes)\n", filename, fileSize)
+func handleFileUpload(conn net.Conn, reader *bufio.Reader, acc *storage.Account, filename string, fileSize int64) error {
+	path, err := storage.ResolvePath(acc.Root(), filename)
+	if err != nil {
+		fmt.Fprintf(conn, "Upload failed: %s: %v\n", filename, err)
+		return nil
+	}
 
-	// Создаем файл для записи данных
-	outFile, err := os.Create(filename)
+	// Открываем частичный файл, оборванная загрузка продолжится с его длины
+	outFile, partPath, offset, err := storage.OpenPartial(acc.Root(), path, fileSize)
+	if errors.Is(err, storage.ErrUploadInProgress) {
+		fmt.Fprintf(conn, "Upload failed: upload of %s already in progress\n", filename)
+		return nil
+	}
 	if err != nil {
 		fmt.Fprintf(conn, "Upload failed: %v\n", err)
-		return
+		return nil
 	}
 	defer outFile.Close()
 
-	// Читаем данные файла
-	bytesReceived := int64(0)
-	buffer := make([]byte, 4096)
-	done := false
+	// Объявленный размер должен уместиться в квоту, поток ограничен ею же
+	quota, err := storage.NewUploadQuota(acc, path, partPath, fileSize)
+	if err != nil {
+		os.Remove(partPath)
+		fmt.Fprintf(conn, "Upload failed: %v\n", err)
+		return nil
+	}
+	defer quota.Release()
 
-	for !done && bytesReceived < fileSize {
-		n, err := reader.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fmt.Fprintf(conn, "Upload failed: %v\n", err)
-			return
-		}
+	// Хеш считается по всему файлу, включая уже принятую часть
+	hasher, err := transfer.HashFile(outFile, offset)
+	if err != nil {
+		fmt.Fprintf(conn, "Upload failed: could not read partial file: %v\n", storage.ClientError(err))
+		return nil
+	}
 
-		data := buffer[:n]
+	// Отправляем подтверждение готовности принять файл
+	fmt.Fprintf(conn, "Ready to receive file '%s' (%d bytes) from offset %d\n", filename, fileSize, offset)
 
-		// Проверяем на маркер конца файла
-		if n >= 4 && string(data[n-4:n]) == "EOF\n" {
-			// Записываем данные без EOF
-			_, err = outFile.Write(data[:n-4])
-			bytesReceived += int64(n - 4)
-			done = true
-		} else {
-			_, err = outFile.Write(data)
-			bytesReceived += int64(n)
-		}
+	// Читаем кадры с данными файла до пустого завершающего кадра,
+	// за ними клиент присылает SHA-256 всего файла
+	bytesReceived, writeErr, err := transfer.ReadFrames(reader, quota.Writer(io.MultiWriter(outFile, hasher), offset))
+	if err != nil {
+		return err
+	}
+	digestLine, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if storage.IsQuotaError(writeErr) {
+		// Превысивший квоту файл не оставляем даже для докачки
+		outFile.Close()
+		os.Remove(partPath)
+		fmt.Fprintf(conn, "Upload failed: %v\n", writeErr)
+		return nil
+	}
+	if writeErr != nil {
+		fmt.Fprintf(conn, "Upload failed: %v\n", writeErr)
+		return nil
+	}
 
-		if err != nil {
-			fmt.Fprintf(conn, "Upload failed: %v\n", err)
-			return
-		}
+	if offset+bytesReceived != fileSize {
+		fmt.Fprintf(conn, "Upload failed: expected %d bytes, received %d\n", fileSize, offset+bytesReceived)
+		return nil
+	}
+
+	// Сверяем хеш, испорченный файл удаляем
+	expected, err := transfer.ParseDigest(digestLine)
+	if err != nil {
+		fmt.Fprintf(conn, "Upload failed: %v\n", err)
+		return nil
+	}
+	if received := transfer.FormatDigest(hasher); received != transfer.DigestPrefix+expected {
+		outFile.Close()
+		os.Remove(partPath)
+		fmt.Fprintf(conn, "Upload failed: %s %s\n", transfer.DigestMismatch, strings.TrimPrefix(received, transfer.DigestPrefix))
+		return nil
+	}
+
+	// Файл принят целиком, даем ему настоящее имя
+	if err := storage.CommitPartial(outFile, partPath, path); err != nil {
+		fmt.Fprintf(conn, "Upload failed: %v\n", err)
+		return nil
 	}
 
 	// Отправляем подтверждение успешной загрузки
-	fmt.Fprintf(conn, "File '%s' uploaded successfully (%d bytes)\n", filename, bytesReceived)
+	fmt.Fprintf(conn, "File '%s' uploaded successfully (%d bytes). %s\n", filename, bytesReceived, transfer.DigestOK)
+	return nil
 }
 
 // Обработка скачивания файла клиентом
-func handleFileDownload(conn net.Conn, filename string) {
+func handleFileDownload(conn net.Conn, reader *bufio.Reader, root, filename string, offset int64) error {
+	path, err := storage.ResolvePath(root, filename)
+	if err != nil {
+		fmt.Fprintf(conn, "Download failed: %s: %v\n", filename, err)
+		return nil
+	}
+
 	// Проверяем существование файла
-	fileInfo, err := os.Stat(filename)
+	fileInfo, err := os.Stat(path)
 	if err != nil {
-		fmt.Fprintf(conn, "Download failed: %v\n", err)
-		return
+		fmt.Fprintf(conn, "Download failed: %v\n", storage.ClientError(err))
+		return nil
 	}
 
 	// Открываем файл для чтения
-	file, err := os.Open(filename)
+	file, err := os.Open(path)
 	if err != nil {
-		fmt.Fprintf(conn, "Download failed: %v\n", err)
-		return
+		fmt.Fprintf(conn, "Download failed: %v\n", storage.ClientError(err))
+		return nil
 	}
 	defer file.Close()
 
-	// Отправляем информацию о файле
-	fmt.Fprintf(conn, "Sending file '%s' (%d bytes)\n", filename, fileInfo.Size())
+	// Клиент докачивает с offset, если файл с тех пор не стал короче
+	if offset < 0 || offset > fileInfo.Size() {
+		offset = 0
+	}
+	hasher, err := transfer.HashFile(file, offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "Download failed: %v\n", storage.ClientError(err))
+		return nil
+	}
 
-	// Отправляем содержимое файла
-	buffer := make([]byte, 4096)
-	for {
-		n, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Error reading file: %v", err)
-			return
-		}
+	// Отправляем информацию о файле
+	fmt.Fprintf(conn, "Sending file '%s' (%d bytes) from offset %d\n", filename, fileInfo.Size(), offset)
 
-		_, err = conn.Write(buffer[:n])
-		if err != nil {
-			log.Printf("Error sending file data: %v", err)
-			return
-		}
+	// Отправляем содержимое файла кадрами, завершая пустым кадром, и его хеш
+	if _, err := transfer.WriteFrames(conn, io.TeeReader(file, hasher)); err != nil {
+		return err
 	}
+	fmt.Fprintf(conn, "%s\n", transfer.FormatDigest(hasher))
 
-	// Отправляем маркер конца файла
-	_, err = conn.Write([]byte("EOF\n"))
+	// Клиент сверяет хеш и сообщает результат
+	verdict, err := reader.ReadString('\n')
 	if err != nil {
-		log.Printf("Error signaling end of file: %v", err)
-		return
+		return err
+	}
+	if verdict = strings.TrimSpace(verdict); verdict != transfer.DigestOK {
+		log.Printf("Client reported a corrupt download of '%s': %s", filename, verdict)
 	}
+	return nil
 }
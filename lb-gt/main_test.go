@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestVerifyChild(t *testing.T) {
+	tests := []struct {
+		greeting string
+		ok       bool
+	}{
+		{"CHILD secret\n", true},
+		{"CHILD other\n", false},
+		{"SSH-2.0-OpenSSH_9.6\n", false},
+		{"2026-01-02T15:04:05Z\n", false}, // Чужой сервер с TIME проверку не проходит
+	}
+	for _, tt := range tests {
+		parent, child := net.Pipe()
+		go child.Write([]byte(tt.greeting))
+
+		err := verifyChild(parent, bufio.NewReader(parent), "secret")
+		if (err == nil) != tt.ok {
+			t.Errorf("verifyChild after %q = %v, want ok %v", tt.greeting, err, tt.ok)
+		}
+		parent.Close()
+		child.Close()
+	}
+}
+
+func TestVerifyChildSilentPeer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for HealthTimeout")
+	}
+	parent, child := net.Pipe()
+	defer child.Close()
+	defer parent.Close()
+
+	// Программа, которая молчит, тоже не дочерний сервер
+	if err := verifyChild(parent, bufio.NewReader(parent), "secret"); err == nil {
+		t.Error("silent peer passed as the child server")
+	}
+}
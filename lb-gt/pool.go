@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Запас дочерних серверов, которые уже запущены и ждут клиента. Пул
+// держит не меньше -pool-min свободных серверов. Если клиент не застал
+// свободного, запас растет до -pool-max, а за PoolShrinkInterval без
+// таких промахов уменьшается на один
+const (
+	PoolShrinkInterval = time.Minute
+	PoolRetryDelay     = time.Second // Пауза после неудачного запуска, чтобы не плодить процессы в цикле
+)
+
+var (
+	idleChildren []*childServer
+	poolTarget   int  // Сколько свободных серверов держать сейчас
+	poolStarting int  // Сколько серверов для запаса еще запускается
+	poolMissed   bool // Клиент не застал свободного сервера с прошлого уменьшения
+	poolWake     = make(chan struct{}, 1)
+)
+
+// Будит refillPool, не блокируясь, если он уже разбужен
+func wakePool() {
+	select {
+	case poolWake <- struct{}{}:
+	default:
+	}
+}
+
+// Отдает самый давний свободный сервер или nil, если запас пуст
+func takeChild() *childServer {
+	mu.Lock()
+	defer mu.Unlock()
+	defer wakePool()
+
+	for len(idleChildren) > 0 {
+		child := idleChildren[0]
+		idleChildren = idleChildren[1:]
+		select {
+		case <-child.exited:
+			// Процесс завершился, но waitChild еще не убрал его из запаса
+			continue
+		default:
+			return child
+		}
+	}
+
+	poolMissed = true
+	if poolTarget < *poolMaxFlag {
+		poolTarget++
+	}
+	return nil
+}
+
+// Убирает сервер из запаса. Вызывается под mu
+func removeIdleChild(child *childServer) {
+	for i, c := range idleChildren {
+		if c == child {
+			idleChildren = append(idleChildren[:i], idleChildren[i+1:]...)
+			return
+		}
+	}
+}
+
+// Пополняет запас в фоне, когда из него взяли сервер или сервер завершился
+func refillPool() {
+	mu.Lock()
+	poolTarget = *poolMinFlag
+	mu.Unlock()
+
+	shrink := time.NewTicker(PoolShrinkInterval)
+	defer shrink.Stop()
+
+	wakePool()
+	for {
+		select {
+		case <-poolWake:
+		case <-shrink.C:
+			shrinkPool()
+		}
+
+		mu.Lock()
+		need := poolTarget - len(idleChildren) - poolStarting
+		if need > 0 {
+			poolStarting += need
+		}
+		mu.Unlock()
+
+		for i := 0; i < need; i++ {
+			go startIdleChild()
+		}
+	}
+}
+
+func startIdleChild() {
+	child, err := startChild()
+	if err != nil {
+		log.Printf("Failed to start child server for the pool: %v", err)
+		time.Sleep(PoolRetryDelay)
+	}
+
+	mu.Lock()
+	poolStarting--
+	if err == nil {
+		idleChildren = append(idleChildren, child)
+		log.Printf("Child server on port %d is ready, %d idle", child.port, len(idleChildren))
+	}
+	mu.Unlock()
+	wakePool()
+}
+
+// Без промахов за интервал уменьшает запас на один. Лишний сервер
+// завершается сам, когда закрыто его управляющее соединение
+func shrinkPool() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if poolMissed {
+		poolMissed = false
+		return
+	}
+	if poolTarget > *poolMinFlag {
+		poolTarget--
+	}
+	if len(idleChildren) > poolTarget {
+		child := idleChildren[0]
+		idleChildren = idleChildren[1:]
+		log.Printf("Stopping idle child server on port %d, keeping %d ready", child.port, poolTarget)
+		child.control.Close()
+	}
+}
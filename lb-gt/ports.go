@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Сколько раз запускать дочерний сервер на новом порту, если он не смог
+// занять выбранный: порт могли занять между проверкой и запуском
+const ChildStartAttempts = 3
+
+var (
+	errNoFreePort  = errors.New("no free port in the child server port range")
+	errChildExited = errors.New("child server exited during startup")
+	errPortTaken   = errors.New("port answered by a program other than the child server")
+)
+
+// Диапазон портов дочерних серверов из -ports. Порт занят, пока процесс
+// на нем не завершился, после этого он снова выдается
+var (
+	firstPort = MainServerPort + 1
+	lastPort  = MainServerPort + 1000
+	nextPort  = firstPort // С него начинается поиск, так порты расходуются по кругу
+	usedPorts = make(map[int]bool)
+)
+
+// Разбирает диапазон first-last
+func parsePortRange(s string) (int, int, error) {
+	firstText, lastText, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("port range %q must look like first-last", s)
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(firstText))
+	last, err2 := strconv.Atoi(strings.TrimSpace(lastText))
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return first, last, nil
+}
+
+// Выдает первый свободный порт диапазона начиная с nextPort. Порты,
+// которые слушает другая программа, пропускаются
+func allocatePort() (int, error) {
+	for i := 0; i < lastPort-firstPort+1; i++ {
+		port, ok := reservePort()
+		if !ok {
+			break
+		}
+		// Проверка идет через систему, поэтому без mu
+		if portFree(port) {
+			return port, nil
+		}
+		releasePort(port)
+	}
+	return 0, errNoFreePort
+}
+
+// Занимает следующий порт диапазона, не выданный другому серверу
+func reservePort() (int, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	size := lastPort - firstPort + 1
+	for i := 0; i < size; i++ {
+		port := firstPort + (nextPort-firstPort+i)%size
+		if usedPorts[port] {
+			continue
+		}
+		usedPorts[port] = true
+		nextPort = port + 1
+		if nextPort > lastPort {
+			nextPort = firstPort
+		}
+		return port, true
+	}
+	return 0, false
+}
+
+func releasePort(port int) {
+	mu.Lock()
+	delete(usedPorts, port)
+	mu.Unlock()
+}
+
+// Проверяет, что порт можно слушать так же, как это делает дочерний сервер
+func portFree(port int) bool {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
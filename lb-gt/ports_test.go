@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		text        string
+		first, last int
+		ok          bool
+	}{
+		{"8082-9081", 8082, 9081, true},
+		{" 9000 - 9010 ", 9000, 9010, true},
+		{"9000-9000", 9000, 9000, true},
+		{"1-65535", 1, 65535, true},
+		{"9010-9000", 0, 0, false},
+		{"0-10", 0, 0, false},
+		{"1-65536", 0, 0, false},
+		{"9000", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		first, last, err := parsePortRange(tt.text)
+		if (err == nil) != tt.ok || first != tt.first || last != tt.last {
+			t.Errorf("parsePortRange(%q) = %d, %d, %v; want %d, %d, ok %v",
+				tt.text, first, last, err, tt.first, tt.last, tt.ok)
+		}
+	}
+}
+
+// freePortRange finds n consecutive ports that can be listened on right now
+func freePortRange(t *testing.T, n int) int {
+	t.Helper()
+	for attempt := 0; attempt < 20; attempt++ {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		free := first+n-1 <= 65535
+		for port := first; free && port < first+n; port++ {
+			free = portFree(port)
+		}
+		if free {
+			return first
+		}
+	}
+	t.Skipf("no %d consecutive free ports", n)
+	return 0
+}
+
+// withPortRange replaces the child server port range for one test
+func withPortRange(t *testing.T, first, last int) {
+	t.Helper()
+	oldFirst, oldLast, oldNext, oldUsed := firstPort, lastPort, nextPort, usedPorts
+	firstPort, lastPort, nextPort, usedPorts = first, last, first, make(map[int]bool)
+	t.Cleanup(func() { firstPort, lastPort, nextPort, usedPorts = oldFirst, oldLast, oldNext, oldUsed })
+}
+
+func TestAllocatePortWraps(t *testing.T) {
+	first := freePortRange(t, 3)
+	withPortRange(t, first, first+2)
+
+	// Поиск начинается после последнего выданного порта и идет по кругу
+	nextPort = first + 2
+	var got []int
+	for i := 0; i < 3; i++ {
+		port, err := allocatePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, port)
+	}
+	if want := []int{first + 2, first, first + 1}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("allocatePort = %v, want %v", got, want)
+	}
+
+	if _, err := allocatePort(); !errors.Is(err, errNoFreePort) {
+		t.Fatalf("allocatePort with all ports used = %v, want %v", err, errNoFreePort)
+	}
+	releasePort(first + 1)
+	if port, err := allocatePort(); err != nil || port != first+1 {
+		t.Errorf("allocatePort after release = %d, %v; want %d", port, err, first+1)
+	}
+}
+
+func TestAllocatePortSkipsTakenPort(t *testing.T) {
+	first := freePortRange(t, 2)
+	withPortRange(t, first, first+1)
+
+	// Порт слушает чужая программа
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if port, err := allocatePort(); err != nil || port != first+1 {
+		t.Fatalf("allocatePort = %d, %v; want %d", port, err, first+1)
+	}
+	if usedPorts[first] {
+		t.Error("port of another program stays reserved")
+	}
+	if _, err := allocatePort(); !errors.Is(err, errNoFreePort) {
+		t.Errorf("allocatePort with the rest taken = %v, want %v", err, errNoFreePort)
+	}
+}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"bufio"
+	"common/storage"
+	"common/transfer"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -21,6 +24,9 @@ func HandleTcpConnections(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
 
+	// Без файла пользователей сессия сразу работает в общем хранилище
+	acc := storage.AnonymousAccount()
+
 	for {
 		cmdLine, err := reader.ReadString('\n')
 		if err != nil {
@@ -38,7 +44,16 @@ func HandleTcpConnections(conn net.Conn) {
 
 		cmd := strings.ToUpper(parts[0])
 
+		if err := storage.Authorize(acc, cmd); err != nil {
+			sendTcpResponse(writer, fmt.Sprintf("Command failed: %v\n", err))
+			continue
+		}
+
 		switch cmd {
+		case "LOGIN":
+			// Пароль может содержать пробелы, поэтому берем остаток строки целиком
+			name, password, _ := strings.Cut(strings.TrimSpace(cmdLine[len(parts[0]):]), " ")
+			acc = handleLoginCommand(writer, acc, name, password)
 		case "TIME":
 			handleTimeCommand(writer)
 		case "ECHO":
@@ -60,20 +75,78 @@ func HandleTcpConnections(conn net.Conn) {
 					fileSize = size
 				}
 			}
-			handleUploadCommand(reader, writer, filename, fileSize)
+			if err := handleUploadCommand(reader, writer, acc, filename, fileSize); err != nil {
+				log.Printf("Upload failed: %v", err)
+				return
+			}
 		case "DOWNLOAD":
 			if len(parts) < 2 {
 				sendTcpResponse(writer, "Download failed: missing filename\n")
 				continue
 			}
 			filename := parts[1]
-			handleDownloadCommand(reader, writer, filename)
+			var offset int64
+			if len(parts) > 2 {
+				offset, _ = strconv.ParseInt(parts[2], 10, 64)
+			}
+			if err := handleDownloadCommand(reader, writer, acc.Root(), filename, offset); err != nil {
+				log.Printf("Download failed: %v", err)
+				return
+			}
+		case "LIST":
+			dir := "."
+			if len(parts) > 1 {
+				dir = parts[1]
+			}
+			handleListCommand(writer, acc.Root(), dir)
+		case "STAT":
+			if len(parts) < 2 {
+				sendTcpResponse(writer, "Stat failed: missing filename\n")
+				continue
+			}
+			handleStatCommand(writer, acc.Root(), parts[1])
+		case "DELETE":
+			if len(parts) < 2 {
+				sendTcpResponse(writer, "Delete failed: missing filename\n")
+				continue
+			}
+			handleDeleteCommand(writer, acc.Root(), parts[1])
+		case "RENAME":
+			if len(parts) < 3 {
+				sendTcpResponse(writer, "Rename failed: usage RENAME <from> <to>\n")
+				continue
+			}
+			handleRenameCommand(writer, acc.Root(), parts[1], parts[2])
+		case "MKDIR":
+			if len(parts) < 2 {
+				sendTcpResponse(writer, "Mkdir failed: missing directory name\n")
+				continue
+			}
+			handleMkdirCommand(writer, acc.Root(), parts[1])
 		default:
 			sendTcpResponse(writer, fmt.Sprintf("Invalid command: %s\n", cmd))
 		}
 	}
 }
 
+// handleLoginCommand returns the session's account after the attempt, a
+// failed LOGIN keeps the previous one
+func handleLoginCommand(writer *bufio.Writer, current *storage.Account, name, password string) *storage.Account {
+	if storage.Users == nil {
+		sendTcpResponse(writer, "Login not required, the server accepts anonymous clients\n")
+		return current
+	}
+
+	acc, err := storage.Login(name, password)
+	if err != nil {
+		log.Printf("Failed login as '%s'", name)
+		sendTcpResponse(writer, fmt.Sprintf("Login failed: %v\n", err))
+		return current
+	}
+	sendTcpResponse(writer, fmt.Sprintf("Logged in as %s\n", acc.Name()))
+	return acc
+}
+
 func handleTimeCommand(writer *bufio.Writer) {
 	currentTime := time.Now().Format(time.RFC3339)
 	sendTcpResponse(writer, fmt.Sprintf("Current time: %s\n", currentTime))
@@ -101,96 +174,188 @@ func handleEchoCommand(reader *bufio.Reader, writer *bufio.Writer, initialMessag
 	}
 }
 
-func handleUploadCommand(reader *bufio.Reader, writer *bufio.Writer, filename string, fileSize int64) {
-	file, err := os.Create(filename)
+func handleUploadCommand(reader *bufio.Reader, writer *bufio.Writer, acc *storage.Account, filename string, fileSize int64) error {
+	path, err := storage.ResolvePath(acc.Root(), filename)
+	if err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: %s: %v\n", filename, err))
+		return nil
+	}
+
+	// Данные копятся в частичном файле, оборванная загрузка продолжится с его длины
+	file, partPath, offset, err := storage.OpenPartial(acc.Root(), path, fileSize)
+	if errors.Is(err, storage.ErrUploadInProgress) {
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: upload of %s already in progress\n", filename))
+		return nil
+	}
 	if err != nil {
 		sendTcpResponse(writer, fmt.Sprintf("Upload failed: could not create file %s: %v\n", filename, err))
-		return
+		return nil
 	}
 	defer file.Close()
 
-	sendTcpResponse(writer, "Ready to receive file. End with EOF\\n\n")
+	// Объявленный размер проверяем до приема, остаток квоты ограничит и поток
+	quota, err := storage.NewUploadQuota(acc, path, partPath, fileSize)
+	if err != nil {
+		os.Remove(partPath)
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: %v\n", err))
+		return nil
+	}
+	defer quota.Release()
 
-	bytesReceived := int64(0)
-	buffer := make([]byte, 4096)
-	eofMarkerFound := false
+	// Клиент пришлет хеш всего файла, поэтому уже принятую часть тоже хешируем
+	hasher, err := transfer.HashFile(file, offset)
+	if err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: could not read partial file: %v\n", storage.ClientError(err)))
+		return nil
+	}
 
-	for !eofMarkerFound {
-		n, err := reader.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			sendTcpResponse(writer, fmt.Sprintf("Upload failed: error reading data: %v\n", err))
-			return
-		}
+	sendTcpResponse(writer, fmt.Sprintf("Ready to receive file '%s' (%d bytes) from offset %d\n", filename, fileSize, offset))
 
-		data := buffer[:n]
-		if n >= 4 {
-			endStr := string(data[n-4 : n])
-			if endStr == "EOF\n" {
-				_, err = file.Write(data[:n-4])
-				eofMarkerFound = true
-				bytesReceived += int64(n - 4)
-			} else {
-				_, err = file.Write(data)
-				bytesReceived += int64(n)
-			}
-		} else {
-			_, err = file.Write(data)
-			bytesReceived += int64(n)
-		}
+	// Хеш считаем по мере записи, клиент пришлет свой после последнего кадра
+	bytesReceived, writeErr, err := transfer.ReadFrames(reader, quota.Writer(io.MultiWriter(file, hasher), offset))
+	if err != nil {
+		return err
+	}
+	digestLine, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if storage.IsQuotaError(writeErr) {
+		file.Close()
+		os.Remove(partPath)
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: %v\n", writeErr))
+		return nil
+	}
+	if writeErr != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: error writing to file: %v\n", writeErr))
+		return nil
+	}
 
-		if err != nil {
-			sendTcpResponse(writer, fmt.Sprintf("Upload failed: error writing to file: %v\n", err))
-			return
-		}
+	if fileSize >= 0 && offset+bytesReceived != fileSize {
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: expected %d bytes, received %d\n", fileSize, offset+bytesReceived))
+		return nil
+	}
 
-		if fileSize > 0 && bytesReceived >= fileSize && eofMarkerFound {
-			break
-		}
+	expected, err := transfer.ParseDigest(digestLine)
+	if err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: %v\n", err))
+		return nil
+	}
+	if received := transfer.FormatDigest(hasher); received != transfer.DigestPrefix+expected {
+		// Испорченный файл не оставляем в хранилище
+		file.Close()
+		os.Remove(partPath)
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: %s %s\n", transfer.DigestMismatch, strings.TrimPrefix(received, transfer.DigestPrefix)))
+		return nil
 	}
 
-	sendTcpResponse(writer, fmt.Sprintf("File '%s' uploaded successfully. Received %d bytes.\n", filename, bytesReceived))
+	if err := storage.CommitPartial(file, partPath, path); err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Upload failed: %v\n", err))
+		return nil
+	}
+
+	sendTcpResponse(writer, fmt.Sprintf("File '%s' uploaded successfully. Received %d bytes. %s\n", filename, bytesReceived, transfer.DigestOK))
+	return nil
 }
 
-func handleDownloadCommand(reader *bufio.Reader, writer *bufio.Writer, filename string) {
-	file, err := os.Open(filename)
+// handleDownloadCommand sends the file starting at offset, the bytes before
+// it are already in the client's partial file
+func handleDownloadCommand(reader *bufio.Reader, writer *bufio.Writer, root, filename string, offset int64) error {
+	path, err := storage.ResolvePath(root, filename)
 	if err != nil {
-		sendTcpResponse(writer, fmt.Sprintf("Download failed: could not open file %s: %v\n", filename, err))
-		return
+		sendTcpResponse(writer, fmt.Sprintf("Download failed: %s: %v\n", filename, err))
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Download failed: could not open file %s: %v\n", filename, storage.ClientError(err)))
+		return nil
 	}
 	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		sendTcpResponse(writer, fmt.Sprintf("Download failed: could not get file info: %v\n", err))
+		sendTcpResponse(writer, fmt.Sprintf("Download failed: could not get file info: %v\n", storage.ClientError(err)))
+		return nil
+	}
+
+	// Файл мог измениться с прошлой попытки, тогда отдаем его целиком
+	if offset < 0 || offset > fileInfo.Size() {
+		offset = 0
+	}
+
+	hasher, err := transfer.HashFile(file, offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Download failed: could not read file: %v\n", storage.ClientError(err)))
+		return nil
+	}
+
+	sendTcpResponse(writer, fmt.Sprintf("Sending file: %s (%d bytes) from offset %d\n", filename, fileInfo.Size(), offset))
+
+	if _, err := transfer.WriteFrames(writer, io.TeeReader(file, hasher)); err != nil {
+		return err
+	}
+	sendTcpResponse(writer, transfer.FormatDigest(hasher)+"\n")
+
+	// Клиент сверяет хеш и сообщает результат
+	verdict, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if verdict = strings.TrimSpace(verdict); verdict != transfer.DigestOK {
+		log.Printf("Client reported a corrupt download of '%s': %s", filename, verdict)
+	}
+	return nil
+}
+
+func handleListCommand(writer *bufio.Writer, root, dir string) {
+	lines, err := storage.List(root, dir)
+	if err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("List failed: %s: %v\n", dir, err))
 		return
 	}
 
-	sendTcpResponse(writer, fmt.Sprintf("Sending file: %s (%d bytes)\n", filename, fileInfo.Size()))
+	for _, line := range lines {
+		writer.WriteString(line + "\n")
+	}
+	sendTcpResponse(writer, "END\n")
+}
 
-	buffer := make([]byte, 4096)
-	for {
-		n, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Download failed: error reading file: %v\n", err)
-			return
-		}
+func handleStatCommand(writer *bufio.Writer, root, filename string) {
+	line, err := storage.Stat(root, filename)
+	if err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Stat failed: %s: %v\n", filename, err))
+		return
+	}
+	sendTcpResponse(writer, line+"\n")
+}
 
-		_, err = writer.Write(buffer[:n])
-		if err != nil {
-			log.Printf("Download failed: error writing to connection: %v\n", err)
-			return
-		}
-		writer.Flush()
+func handleDeleteCommand(writer *bufio.Writer, root, filename string) {
+	if err := storage.Delete(root, filename); err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Delete failed: %s: %v\n", filename, err))
+		return
 	}
+	sendTcpResponse(writer, fmt.Sprintf("Deleted '%s'\n", filename))
+}
 
-	writer.WriteString("EOF\n")
-	writer.Flush()
+func handleRenameCommand(writer *bufio.Writer, root, from, to string) {
+	if err := storage.Rename(root, from, to); err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Rename failed: %s: %v\n", from, err))
+		return
+	}
+	sendTcpResponse(writer, fmt.Sprintf("Renamed '%s' to '%s'\n", from, to))
+}
+
+func handleMkdirCommand(writer *bufio.Writer, root, dir string) {
+	if err := storage.MakeDir(root, dir); err != nil {
+		sendTcpResponse(writer, fmt.Sprintf("Mkdir failed: %s: %v\n", dir, err))
+		return
+	}
+	sendTcpResponse(writer, fmt.Sprintf("Created directory '%s'\n", dir))
 }
 
 func sendTcpResponse(writer *bufio.Writer, message string) {
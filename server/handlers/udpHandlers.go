@@ -1,8 +1,10 @@
 package handlers
 
 import (
-	"bufio"
-	"encoding/binary"
+	"common/storage"
+	"common/transfer"
+	"common/udp"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -12,16 +14,13 @@ import (
 )
 
 const (
-	DatagramSize  = 1500 // Recommended datagram size per ethernet mtu limitations
-	SlidingWindow = 8    // We will receive ACK for 3 packages
-	BuffSize      = 64 * 1024 * 1024
-	UdpTimeout    = time.Millisecond * 100
-)
+	BuffSize     = 64 * 1024 * 1024
+	UdpTimeout   = time.Millisecond * 100
+	CloseRetries = 10
+	CloseLinger  = 10 * UdpTimeout // How long a finished upload keeps answering repeated MsgClose
 
-type Packet struct {
-	SeqNum uint32
-	Data   []byte
-}
+	MaxResponseSize = 60 * 1024 // LIST replies are sent in one datagram and cut at this size
+)
 
 // ProgressBar displays a simple progress bar in console
 func ProgressBar(current, total int, operation string) {
@@ -42,249 +41,345 @@ func ProgressBar(current, total int, operation string) {
 	fmt.Printf("\r%s %s %.2f%% (%d/%d)", operation, bar, percent*100, current, total)
 }
 
-func HandleUdpConnections(conn *net.UDPConn) {
-	buffer := make([]byte, DatagramSize)
-
-	for {
-		n, addr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			fmt.Printf("Error reading from UDP: %v\n", err)
-			continue
-		}
-
-		processCommand(conn, addr, buffer[:n])
-	}
-}
-
-func processCommand(conn *net.UDPConn, addr *net.UDPAddr, data []byte) {
+func processCommand(sess *udpSession, data []byte) {
 	cmd := strings.TrimSpace(string(data))
 
 	// Разбиваем команду на части, учитывая что и UPLOAD и DOWNLOAD могут иметь offset
 	parts := strings.SplitN(cmd, " ", 3)
 
 	if len(parts) == 0 {
-		sendResponse(conn, addr, "ERROR: Empty command")
+		sess.respond("ERROR: Empty command")
 		return
 	}
 
 	command := strings.ToUpper(parts[0])
 
+	if err := storage.Authorize(sess.account, command); err != nil {
+		sess.respond(fmt.Sprintf("ERROR: %v", err))
+		return
+	}
+	root := ""
+	if sess.account != nil {
+		root = sess.account.Root()
+	}
+
 	switch command {
+	case "LOGIN":
+		if len(parts) < 3 {
+			sess.respond("ERROR: Usage LOGIN <user> <password>")
+			return
+		}
+		handleLogin(sess, parts[1], parts[2])
+
 	case "ECHO":
 		param := ""
 		if len(parts) > 1 {
 			param = parts[1]
 		}
-		handleEcho(conn, addr, param)
+		handleEcho(sess, param)
 
 	case "TIME":
-		handleTime(conn, addr)
+		handleTime(sess)
+
+	case "UPLOAD", "DOWNLOAD":
+		// Передача файлов идет через MsgOpen со своим заголовком, см. udpProtocol.go
+		sess.respond(fmt.Sprintf("ERROR: %s requires a transfer session (protocol version %d)", command, udp.ProtocolVersion))
+
+	case "LIST":
+		dir := "."
+		if len(parts) > 1 {
+			dir = parts[1]
+		}
+		handleList(sess, root, dir)
 
-	case "UPLOAD":
-		// Обрабатываем два варианта:
-		// 1. UPLOAD filename
-		// 2. UPLOAD filename offset
+	case "STAT":
 		if len(parts) < 2 {
-			sendResponse(conn, addr, "ERROR: Filename required for upload")
+			sess.respond("ERROR: Filename required for stat")
 			return
 		}
+		handleStat(sess, root, parts[1])
 
-		params := []string{parts[1]} // filename
-		if len(parts) > 2 {
-			params = append(params, parts[2]) // добавляем offset если есть
+	case "DELETE":
+		if len(parts) < 2 {
+			sess.respond("ERROR: Filename required for delete")
+			return
 		}
-		handleUpload(conn, addr, params)
+		handleDelete(sess, root, parts[1])
 
-	case "DOWNLOAD":
-		// Обрабатываем два варианта:
-		// 1. DOWNLOAD filename
-		// 2. DOWNLOAD filename offset
-		if len(parts) < 2 {
-			sendResponse(conn, addr, "ERROR: Filename required for download")
+	case "RENAME":
+		if len(parts) < 3 {
+			sess.respond("ERROR: Usage RENAME <from> <to>")
 			return
 		}
+		handleRename(sess, root, parts[1], parts[2])
 
-		params := []string{parts[1]} // filename
-		if len(parts) > 2 {
-			params = append(params, parts[2]) // добавляем offset если есть
+	case "MKDIR":
+		if len(parts) < 2 {
+			sess.respond("ERROR: Directory name required for mkdir")
+			return
 		}
-		handleDownload(conn, addr, params)
+		handleMkdir(sess, root, parts[1])
 
 	default:
-		sendResponse(conn, addr, fmt.Sprintf("ERROR: Unknown command '%s'", command))
+		sess.respond(fmt.Sprintf("ERROR: Unknown command '%s'", command))
 	}
 }
 
-func handleEcho(conn *net.UDPConn, addr *net.UDPAddr, text string) {
-	sendResponse(conn, addr, text)
+// handleLogin checks the password and answers with the token that later
+// commands and transfers of the client carry instead of the password
+func handleLogin(sess *udpSession, name, password string) {
+	if storage.Users == nil {
+		sess.respond("Login not required, the server accepts anonymous clients")
+		return
+	}
+	if RefusePlainLogin && sess.cipher == nil {
+		sess.respond("ERROR: Server does not take passwords over plain UDP, log in with the pre-shared key or over TLS")
+		return
+	}
+
+	acc, err := storage.Login(name, password)
+	if err != nil {
+		fmt.Printf("Failed login as '%s' from %s\n", name, sess.addr)
+		sess.respond(fmt.Sprintf("ERROR: Login failed: %v", err))
+		return
+	}
+	sess.account = acc
+	token := sess.dispatcher.saveLogin(acc)
+	sess.respond(fmt.Sprintf("Logged in as %s, token %s", acc.Name(), token))
+}
+
+func handleEcho(sess *udpSession, text string) {
+	sess.respond(text)
 }
 
-func handleTime(conn *net.UDPConn, addr *net.UDPAddr) {
+func handleTime(sess *udpSession) {
 	currentTime := time.Now().Format(time.RFC3339)
-	sendResponse(conn, addr, currentTime)
+	sess.respond(currentTime)
 }
 
-func handleUpload(conn *net.UDPConn, addr *net.UDPAddr, args []string) {
-	defer conn.SetReadDeadline(time.Time{})
+func handleList(sess *udpSession, root, dir string) {
+	lines, err := storage.List(root, dir)
+	if err != nil {
+		sess.respond(fmt.Sprintf("ERROR: %s: %v", dir, err))
+		return
+	}
+
+	// Весь список должен поместиться в одну датаграмму
+	var response strings.Builder
+	for i, line := range lines {
+		if response.Len()+len(line)+1 > MaxResponseSize {
+			fmt.Fprintf(&response, "... %d more entries", len(lines)-i)
+			break
+		}
+		response.WriteString(line + "\n")
+	}
+	if len(lines) == 0 {
+		response.WriteString("(empty)")
+	}
+
+	sess.respond(strings.TrimSuffix(response.String(), "\n"))
+}
+
+func handleStat(sess *udpSession, root, filename string) {
+	line, err := storage.Stat(root, filename)
+	if err != nil {
+		sess.respond(fmt.Sprintf("ERROR: %s: %v", filename, err))
+		return
+	}
+	sess.respond(line)
+}
+
+func handleDelete(sess *udpSession, root, filename string) {
+	if err := storage.Delete(root, filename); err != nil {
+		sess.respond(fmt.Sprintf("ERROR: %s: %v", filename, err))
+		return
+	}
+	sess.respond(fmt.Sprintf("Deleted '%s'", filename))
+}
+
+func handleRename(sess *udpSession, root, from, to string) {
+	if err := storage.Rename(root, from, to); err != nil {
+		sess.respond(fmt.Sprintf("ERROR: %s: %v", from, err))
+		return
+	}
+	sess.respond(fmt.Sprintf("Renamed '%s' to '%s'", from, to))
+}
+
+func handleMkdir(sess *udpSession, root, dir string) {
+	if err := storage.MakeDir(root, dir); err != nil {
+		sess.respond(fmt.Sprintf("ERROR: %s: %v", dir, err))
+		return
+	}
+	sess.respond(fmt.Sprintf("Created directory '%s'", dir))
+}
+
+func handleUpload(sess *udpSession, args []string) {
+	addr := sess.addr
 	if len(args) < 1 {
-		sendResponse(conn, addr, "ERROR: Filename required for upload")
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Filename required for upload"))
 		return
 	}
 
 	filename := args[0]
-	offset := 0
+	var fileSize int64 = -1
 	if len(args) > 1 {
 		var err error
-		offset, err = strconv.Atoi(args[1])
-		if err != nil || offset < 0 {
-			sendResponse(conn, addr, "ERROR: Invalid offset value")
+		fileSize, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil || fileSize < 0 {
+			sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Invalid file size"))
 			return
 		}
 	}
 
-	fmt.Printf("\nReceiving upload for file '%s' from %s (offset: %d)\n",
-		filename, addr.String(), offset)
-
-	// Открываем файл для дозаписи или создаем новый
-	var outputFile *os.File
-	var err error
-
-	if offset > 0 {
-		outputFile, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
-		if err == nil {
-			_, err = outputFile.Seek(int64(offset), 0)
-		}
-	} else {
-		outputFile, err = os.Create(filename)
+	path, err := storage.ResolvePath(sess.account.Root(), filename)
+	if err != nil {
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: %s: %v", filename, err)))
+		return
 	}
 
+	// Offset выбирает сервер: это длина частичного файла, в который чанки
+	// пишутся строго подряд, то есть ровно то, что уже надежно записано
+	outputFile, partPath, offset, err := storage.OpenPartial(sess.account.Root(), path, fileSize)
+	if errors.Is(err, storage.ErrUploadInProgress) {
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: upload of %s already in progress", filename)))
+		return
+	}
 	if err != nil {
-		sendResponse(conn, addr, fmt.Sprintf("ERROR: Could not open file: %v", err))
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: Could not open file: %v", err)))
 		return
 	}
 	defer outputFile.Close()
 
-	bufWriter := bufio.NewWriterSize(outputFile, BuffSize)
-	defer bufWriter.Flush()
+	// Объявленный размер проверяем сразу, дальше квоту сверяем с каждым чанком
+	quota, err := storage.NewUploadQuota(sess.account, path, partPath, fileSize)
+	if err != nil {
+		os.Remove(partPath)
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: %v", err)))
+		return
+	}
+	defer quota.Release()
 
-	// Немедленная отправка подтверждения
-	sendResponse(conn, addr, fmt.Sprintf("READY: Offset %d", offset))
+	fmt.Printf("\nReceiving upload for file '%s' from %s (session %08x, offset: %d)\n",
+		filename, addr.String(), sess.id, offset)
 
-	buffer := make([]byte, DatagramSize)
-	totalBytes := offset
-	start := time.Now()
-	lastProgressUpdate := time.Now()
-	lastAckTime := time.Now()
-	eofReceived := false
+	// Клиент пришлет хеш всего файла, поэтому уже записанную часть тоже хешируем
+	hasher, err := transfer.HashFile(outputFile, offset)
+	if err != nil {
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Could not read partial file"))
+		return
+	}
+	receiver := udp.NewChunkReceiver(outputFile, offset, hasher)
 
-	// Для отслеживания полученных чанков
-	receivedChunks := make(map[int]bool)
+	// Подтверждаем открытие сессии, клиент узнает из заголовка ее ID
+	openAck := []byte(fmt.Sprintf("READY: Offset %d", offset))
+	sess.sendMsg(udp.MsgOpenAck, sess.token, openAck)
+	openAckSent := time.Now()
+	openAcks := 1
 
-	// Настройки таймаутов
-	normalTimeout := UdpTimeout
-	finalTimeout := UdpTimeout
-	currentTimeout := normalTimeout
+	start := time.Now()
+	lastActivity := time.Now()
+	dataSeen := false
+	var finalResponse []byte
 
 	for {
-		// Обновляем прогресс
-		if time.Since(lastProgressUpdate) > UdpTimeout {
-			go ProgressBar(totalBytes, totalBytes, "Receiving")
-			lastProgressUpdate = time.Now()
-		}
-
-		// Устанавливаем таймаут
-		conn.SetReadDeadline(time.Now().Add(currentTimeout))
-
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
+		h, payload, err := sess.readMsg(sess.rtt.Timeout())
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				if eofReceived && time.Since(lastAckTime) > finalTimeout {
-					break
-				}
-				continue
+			// После MsgClose ждем немного, вдруг MsgCloseAck потерялся
+			if finalResponse != nil && time.Since(lastActivity) > CloseLinger {
+				return
 			}
-			fmt.Println("\nError receiving data:", err)
-			return
-		}
-
-		// Проверяем адрес отправителя
-		if clientAddr.String() != addr.String() {
-			continue
-		}
-
-		// Обработка EOF
-		if n >= 3 && string(buffer[:3]) == "EOF" {
-			if !eofReceived {
-				eofReceived = true
-				currentTimeout = finalTimeout
-				fmt.Println("\nEOF marker received, finalizing...")
-				sendResponse(conn, addr, "ACKEOF")
+			if time.Since(lastActivity) > SessionIdleTimeout {
+				fmt.Println("\nClient stopped sending, aborting upload")
+				return
+			}
+			// Потерянный ACK мог остановить окно клиента, повторяем его
+			if finalResponse == nil && dataSeen {
+				sess.sendMsg(udp.MsgAck, receiver.Next(), receiver.SackBitmap())
 			}
+			sess.rtt.Expired()
 			continue
 		}
-
-		// Обработка данных
-		chunkIndex := totalBytes / DatagramSize
-		if !receivedChunks[chunkIndex] {
-			if _, err := bufWriter.Write(buffer[:n]); err != nil {
-				fmt.Println("\nError writing to file:", err)
-				sendResponse(conn, addr, fmt.Sprintf("ERROR: Write failed: %v", err))
-				return
+		lastActivity = time.Now()
+
+		switch h.Type {
+		case udp.MsgOpen:
+			// Клиент не получил MsgOpenAck
+			sess.sendMsg(udp.MsgOpenAck, sess.token, openAck)
+			openAcks++
+
+		case udp.MsgData:
+			// Первый чанк отправлен сразу по получении MsgOpenAck, это и есть замер RTT
+			if !dataSeen && openAcks == 1 {
+				sess.rtt.Sample(time.Since(openAckSent))
 			}
+			dataSeen = true
+
+			// Чанки вне очереди ждут в памяти, пока не придут пропущенные
+			if finalResponse == nil {
+				if err := quota.Check(offset + int64(h.Seq)*udp.ChunkSize + int64(len(payload))); err != nil {
+					fmt.Printf("\nUpload of '%s' from %s stopped: %v\n", filename, addr, err)
+					os.Remove(partPath)
+					sess.sendMsg(udp.MsgError, receiver.Next(), []byte(fmt.Sprintf("ERROR: %v", err)))
+					return
+				}
+				if err := receiver.Accept(h.Seq, payload); err != nil {
+					fmt.Println("\nError writing to file:", err)
+					sess.sendMsg(udp.MsgError, receiver.Next(), []byte(fmt.Sprintf("ERROR: Write failed: %v", err)))
+					return
+				}
+			}
+			sess.sendMsg(udp.MsgAck, receiver.Next(), receiver.SackBitmap())
 
-			receivedChunks[chunkIndex] = true
-			totalBytes += n
-			lastAckTime = time.Now()
+		case udp.MsgClose:
+			if finalResponse == nil {
+				if !receiver.Complete(h.Seq) {
+					sess.sendMsg(udp.MsgAck, receiver.Next(), receiver.SackBitmap())
+					continue
+				}
 
-			// Отправляем подтверждение
-			ack := fmt.Sprintf("ACK:%d", chunkIndex)
-			if _, err := conn.WriteToUDP([]byte(ack), addr); err != nil {
-				fmt.Println("\nError sending ACK:", err)
-			}
-		}
-	}
+				totalBytes := offset + receiver.Written()
+				if fileSize >= 0 && totalBytes != fileSize {
+					finalResponse = []byte(fmt.Sprintf("ERROR: Expected %d bytes, received %d", fileSize, totalBytes))
+					sess.sendMsg(udp.MsgCloseAck, receiver.Next(), finalResponse)
+					continue
+				}
 
-	// Финальные операции
-	if err := bufWriter.Flush(); err != nil {
-		fmt.Println("\nError flushing buffer:", err)
-		sendResponse(conn, addr, fmt.Sprintf("ERROR: Flush failed: %v", err))
-		return
-	}
+				if expected, err := transfer.ParseDigest(string(payload)); err != nil || expected != receiver.Digest() {
+					fmt.Printf("\nFile '%s' from %s failed SHA-256 verification, discarding it\n", filename, addr)
+					os.Remove(partPath)
+					finalResponse = []byte(fmt.Sprintf("ERROR: %s %s", transfer.DigestMismatch, receiver.Digest()))
+					sess.sendMsg(udp.MsgCloseAck, receiver.Next(), finalResponse)
+					continue
+				}
 
-	elapsed := time.Since(start).Seconds()
-	speed := float64(totalBytes-offset) / (1024 * 1024 * elapsed)
-	go ProgressBar(totalBytes, totalBytes, "Receiving")
-	fmt.Printf("\nFile '%s' received successfully (%d bytes in %.2f seconds, %.2f MB/s)\n",
-		filename, totalBytes-offset, elapsed, speed)
+				// Файл принят и проверен, даем ему настоящее имя
+				if err := storage.CommitPartial(outputFile, partPath, path); err != nil {
+					sess.sendMsg(udp.MsgError, receiver.Next(), []byte(fmt.Sprintf("ERROR: %v", err)))
+					return
+				}
 
-	// Отправляем финальное подтверждение
-	finalResponse := fmt.Sprintf("SUCCESS: Received %d bytes (total %d)", totalBytes-offset, totalBytes)
-	for i := 0; i < 3; i++ {
-		sendResponse(conn, addr, finalResponse)
-		time.Sleep(50 * time.Millisecond)
-	}
-}
+				elapsed := time.Since(start).Seconds()
+				speed := float64(receiver.Written()) / (1024 * 1024 * elapsed)
+				fmt.Printf("\nFile '%s' received successfully (%d bytes in %.2f seconds, %.2f MB/s, %d corrupt datagrams dropped)\n",
+					filename, receiver.Written(), elapsed, speed, sess.corrupt.Load())
 
-//func sendResponse(conn *net.UDPConn, addr *net.UDPAddr, message string) {
-//	if _, err := conn.WriteToUDP([]byte(message), addr); err != nil {
-//		fmt.Println("Error sending response:", err)
-//	}
-//}
+				finalResponse = []byte(fmt.Sprintf("SUCCESS: Received %d bytes (total %d), %s", receiver.Written(), totalBytes, transfer.DigestOK))
+			}
+			sess.sendMsg(udp.MsgCloseAck, receiver.Next(), finalResponse)
 
-func sendResponseDownload(conn *net.UDPConn, addr *net.UDPAddr, message string) bool {
-	if _, err := conn.WriteToUDP([]byte(message), addr); err != nil {
-		fmt.Println("Error sending response:", err)
-		return false
+		case udp.MsgError:
+			fmt.Printf("\nClient aborted upload of '%s': %s\n", filename, payload)
+			return
+		}
 	}
-	return true
 }
 
-func handleDownload(conn *net.UDPConn, addr *net.UDPAddr, args []string) {
+func handleDownload(sess *udpSession, args []string) {
+	conn, addr := sess.conn, sess.addr
 	if len(args) < 1 {
-		sendResponse(conn, addr, "ERROR: Filename required")
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Filename required"))
 		return
 	}
-	defer conn.SetReadDeadline(time.Time{})
 
 	filename := args[0]
 	offset := 0
@@ -292,122 +387,143 @@ func handleDownload(conn *net.UDPConn, addr *net.UDPAddr, args []string) {
 		var err error
 		offset, err = strconv.Atoi(args[1])
 		if err != nil || offset < 0 {
-			sendResponse(conn, addr, "ERROR: Invalid offset")
+			sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Invalid offset"))
 			return
 		}
 	}
 
-	fileInfo, err := os.Stat(filename)
+	path, err := storage.ResolvePath(sess.account.Root(), filename)
+	if err != nil {
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: %s: %v", filename, err)))
+		return
+	}
+
+	fileInfo, err := os.Stat(path)
 	if err != nil {
-		sendResponse(conn, addr, "FILE_NOT_FOUND")
+		sess.sendMsg(udp.MsgError, sess.token, []byte("FILE_NOT_FOUND"))
 		return
 	}
 
 	if fileInfo.IsDir() {
-		sendResponse(conn, addr, "ERROR: Is directory")
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Is directory"))
 		return
 	}
 
-	fileData, err := os.ReadFile(filename)
+	// Файл не читается целиком: чанки загружаются по мере отправки
+	file, err := os.Open(path)
 	if err != nil {
-		sendResponse(conn, addr, "ERROR: Reading file")
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Reading file"))
 		return
 	}
+	defer file.Close()
 
-	fileSize := len(fileData)
+	fileSize := int(fileInfo.Size())
 	if offset > fileSize {
-		sendResponse(conn, addr, "ERROR: Offset too large")
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Offset too large"))
 		return
 	}
 
 	if fileSize == 0 {
-		sendResponse(conn, addr, "ERROR: Empty file")
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Empty file"))
 		return
 	}
 
-	fmt.Printf("\nSending '%s' (%d bytes) to %s from offset %d\n",
-		filename, fileSize, addr, offset)
+	fmt.Printf("\nSending '%s' (%d bytes) to %s from offset %d (session %08x)\n",
+		filename, fileSize, addr, offset, sess.id)
 
-	// Send file size
-	if !sendResponse(conn, addr, fmt.Sprintf("SIZE %d", fileSize)) {
-		return
-	}
-
-	// Wait for ACK
-	if !waitForACK(conn, addr) {
+	// Send file size and wait until the client confirms it with the first ACK
+	openAck := []byte(fmt.Sprintf("SIZE %d", fileSize))
+	if !waitForStart(sess, openAck) {
 		fmt.Println("No ACK received")
 		return
 	}
 
 	conn.SetWriteBuffer(BuffSize)
-	remainingData := fileData[offset:]
+	remaining := fileSize - offset
 	start := time.Now()
 
-	// Sliding window implementation
-	window := make([]Packet, SlidingWindow)
-	ackChan := make(chan uint32, SlidingWindow)
-	retryChan := make(chan uint32, SlidingWindow)
-
-	go receiveACKs(conn, ackChan)
+	numChunks := (remaining + udp.ChunkSize - 1) / udp.ChunkSize
+	loadChunk := func(seq uint32) ([]byte, error) {
+		return udp.ReadChunk(file, int64(offset), int64(remaining), seq)
+	}
+	sendChunk := func(seq uint32, data []byte) error {
+		if !sess.sendMsg(udp.MsgData, seq, data) {
+			return fmt.Errorf("could not send chunk %d", seq)
+		}
+		return nil
+	}
 
-	startSeq := offset / DatagramSize
-	i := 0
-	numChunks := (len(remainingData) + DatagramSize - 1) / DatagramSize
+	// Sliding window with selective acknowledgements, timers follow the measured RTT
+	sender := udp.NewChunkSender(uint32(numChunks), udp.NewCongestionWindow(udp.SlidingWindow, udp.MaxWindow), sess.rtt, loadChunk, sendChunk)
+	lastAck := time.Now()
 
-	for i < numChunks {
-		// Fill window
-		for j := 0; j < SlidingWindow && i+j < numChunks; j++ {
-			startPos := (i + j) * DatagramSize
-			endPos := startPos + DatagramSize
-			if endPos > len(remainingData) {
-				endPos = len(remainingData)
-			}
-
-			packet := Packet{
-				SeqNum: uint32(startSeq + i + j),
-				Data:   remainingData[startPos:endPos],
-			}
-			window[j] = packet
-			sendPacket(conn, addr, packet, retryChan)
+	for !sender.Done() {
+		if err := sender.Fill(); err != nil {
+			fmt.Println("\nError sending file:", err)
+			return
 		}
 
-		// Process ACKs
-		for j := 0; j < SlidingWindow && i < numChunks; j++ {
-			select {
-			case ack := <-ackChan:
-				if ack >= uint32(startSeq+i) {
-					acked := int(ack) - (startSeq + i) + 1
-					i += acked
-					window = window[acked:]
-					window = append(window, make([]Packet, acked)...)
-				}
-			case seq := <-retryChan:
-				for _, p := range window {
-					if p.SeqNum == seq {
-						sendPacket(conn, addr, p, retryChan)
-						break
-					}
-				}
-			case <-time.After(UdpTimeout):
-				// Resend entire window on timeout
-				for _, p := range window {
-					if p.Data != nil {
-						sendPacket(conn, addr, p, retryChan)
-					}
+		h, payload, err := sess.readMsg(sender.NextTimeout())
+		if err == nil {
+			switch h.Type {
+			case udp.MsgAck:
+				lastAck = time.Now()
+				if err := sender.OnAck(h.Seq, payload); err != nil {
+					fmt.Println("\nError sending file:", err)
+					return
 				}
+			case udp.MsgError:
+				fmt.Printf("\nClient %s aborted the download: %s\n", addr, payload)
+				return
 			}
+		} else if time.Since(lastAck) > SessionIdleTimeout {
+			fmt.Printf("\nClient %s stopped acknowledging, aborting download\n", addr)
+			return
+		}
+
+		// Resend only the chunks whose own timer expired
+		if _, err := sender.RetransmitExpired(); err != nil {
+			fmt.Println("\nError sending file:", err)
+			return
 		}
 	}
 
-	// Send EOF marker
-	for i := 0; i < 3; i++ {
-		sendResponse(conn, addr, "EOF")
-		time.Sleep(50 * time.Millisecond)
+	// MsgClose carries the SHA-256 of the whole file, the client checks it
+	hasher, err := transfer.HashFile(file, int64(fileSize))
+	if err != nil {
+		fmt.Println("\nError hashing file:", err)
+		sess.sendMsg(udp.MsgError, uint32(numChunks), []byte("ERROR: Reading file"))
+		return
+	}
+	digest := []byte(transfer.FormatDigest(hasher))
+
+	// Close handshake: repeat MsgClose until the client confirms the whole file
+	for attempt := 0; attempt < CloseRetries; attempt++ {
+		sess.sendMsg(udp.MsgClose, uint32(numChunks), digest)
+		if _, payload, ok := sess.awaitMsg(udp.MsgCloseAck, sess.rtt.Timeout()); ok {
+			if strings.HasPrefix(string(payload), transfer.DigestMismatch) {
+				fmt.Printf("\nClient %s reported a corrupt download of '%s': %s", addr, filename, payload)
+			} else {
+				fmt.Printf("\nClient confirmed download: %s", payload)
+			}
+			break
+		}
+		sess.rtt.Expired()
 	}
 
 	elapsed := time.Since(start).Seconds()
-	fmt.Printf("\nTransfer completed in %.2fs (%.2f MB/s)\n",
-		elapsed, float64(len(remainingData))/(1024*1024*elapsed))
+	fmt.Printf("\nTransfer completed in %.2fs (%.2f MB/s, %d chunks retransmitted, %d corrupt datagrams dropped)\n",
+		elapsed, float64(remaining)/(1024*1024*elapsed), sender.Retransmits(), sess.corrupt.Load())
+}
+
+// respond answers a text command, sealed in MsgReply inside an encrypted command session
+func (s *udpSession) respond(msg string) {
+	if s.cipher != nil {
+		s.reply = []byte(msg)
+		s.sendMsg(udp.MsgReply, s.replySeq, s.reply)
+		return
+	}
+	sendResponse(s.conn, s.addr, msg)
 }
 
 func sendResponse(conn *net.UDPConn, addr *net.UDPAddr, msg string) bool {
@@ -419,40 +535,31 @@ func sendResponse(conn *net.UDPConn, addr *net.UDPAddr, msg string) bool {
 	return true
 }
 
-func waitForACK(conn *net.UDPConn, addr *net.UDPAddr) bool {
-	buf := make([]byte, 3)
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, _, err := conn.ReadFromUDP(buf)
-	if err != nil {
-		return false
-	}
-	return string(buf[:n]) == "ACK"
-}
+// waitForStart sends MsgOpenAck until the client answers with its first MsgAck
+func waitForStart(sess *udpSession, openAck []byte) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for attempt := 0; time.Now().Before(deadline); attempt++ {
+		sess.sendMsg(udp.MsgOpenAck, sess.token, openAck)
+		sent := time.Now()
 
-func receiveACKs(conn *net.UDPConn, ackChan chan<- uint32) {
-	buf := make([]byte, 8)
-	for {
-		n, _, err := conn.ReadFromUDP(buf)
+		h, _, err := sess.readMsg(sess.rtt.Timeout())
 		if err != nil {
+			sess.rtt.Expired()
 			continue
 		}
-
-		if n >= 4 {
-			seq := binary.BigEndian.Uint32(buf[:4])
-			ackChan <- seq
-		} else if string(buf[:n]) == "ACK" {
-			ackChan <- 0
+		if h.Type == udp.MsgOpen {
+			continue
+		}
+		if h.Type == udp.MsgAck {
+			// Первый обмен служит начальным замером RTT
+			if attempt == 0 {
+				sess.rtt.Sample(time.Since(sent))
+			}
+			return true
+		}
+		if h.Type == udp.MsgError {
+			return false
 		}
 	}
-}
-
-func sendPacket(conn *net.UDPConn, addr *net.UDPAddr, p Packet, retryChan chan<- uint32) {
-	buf := make([]byte, 4+len(p.Data))
-	binary.BigEndian.PutUint32(buf[:4], p.SeqNum)
-	copy(buf[4:], p.Data)
-
-	_, err := conn.WriteToUDP(buf, addr)
-	if err != nil {
-		retryChan <- p.SeqNum
-	}
+	return false
 }
@@ -0,0 +1,477 @@
+package handlers
+
+import (
+	"bytes"
+	"common/storage"
+	"common/udp"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MaxDatagramSize    = 64 * 1024
+	SessionInboxSize   = 1024 // Datagrams queued per session before new ones are dropped
+	SessionIdleTimeout = 30 * time.Second
+	LoginIdleTimeout   = 30 * time.Minute // A token unused for this long has to be replaced by a new LOGIN
+	LoginTokenSize     = 16
+)
+
+var (
+	errSessionTimeout = errors.New("session read timeout")
+	errLoginExpired   = errors.New("login expired, send LOGIN again")
+)
+
+// RefusePlainLogin rejects UDP LOGIN outside an encrypted session, set when
+// TCP runs over TLS so the password never crosses the network in clear
+var RefusePlainLogin bool
+
+// udpSession owns the datagrams of one peer or of one file transfer. The
+// shared socket is read only by the dispatcher, which hands every datagram
+// to its session, so transfers never steal each other's packets.
+type udpSession struct {
+	conn       *net.UDPConn
+	addr       *net.UDPAddr
+	inbox      chan []byte
+	dispatcher *udpDispatcher
+
+	id    uint32 // Transfer session ID, 0 for the text command session of a peer
+	token uint32 // Client token from MsgOpen, echoed in MsgOpenAck
+	rtt   *udp.RttEstimator
+
+	account    *storage.Account // Login named by the token of the current request, nil without one
+	cipher     *udp.Cipher      // Set when the transfer is encrypted with PreSharedKey
+	serverSalt []byte           // Sent in clear in front of sealed MsgOpenAck and MsgError
+	corrupt    atomic.Int64     // Datagrams dropped by the dispatcher for a bad checksum
+
+	// Reply to the MsgCommand with seq replySeq, repeated if the client asks again
+	replySeq uint32
+	reply    []byte
+}
+
+type udpDispatcher struct {
+	conn      *net.UDPConn
+	mu        sync.Mutex
+	peers     map[string]*udpSession // Text commands, keyed by peer address
+	transfers map[uint32]*udpSession // File transfers, keyed by session ID
+	opens     map[string]uint32      // Peer address and open token to session ID
+	logins    map[string]*udpLogin   // Accounts of logged in clients, keyed by login token
+}
+
+// udpLogin outlives the command session of a peer, which ends after
+// SessionIdleTimeout. UDP has no connection and a source address is easy to
+// forge, so LOGIN answers with a random token and the client starts every
+// command and transfer request with "AUTH <token> ".
+type udpLogin struct {
+	account  *storage.Account
+	lastSeen time.Time
+}
+
+func HandleUdpConnections(conn *net.UDPConn) {
+	conn.SetReadBuffer(BuffSize)
+
+	d := &udpDispatcher{
+		conn:      conn,
+		peers:     make(map[string]*udpSession),
+		transfers: make(map[uint32]*udpSession),
+		opens:     make(map[string]uint32),
+		logins:    make(map[string]*udpLogin),
+	}
+
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			fmt.Printf("Error reading from UDP: %v\n", err)
+			continue
+		}
+
+		data := append([]byte(nil), buffer[:n]...)
+		if udp.IsTransferDatagram(data) {
+			d.dispatchTransfer(addr, data)
+		} else {
+			d.dispatchCommand(addr, data)
+		}
+	}
+}
+
+func (d *udpDispatcher) newSession(addr *net.UDPAddr) *udpSession {
+	return &udpSession{
+		conn:       d.conn,
+		addr:       addr,
+		inbox:      make(chan []byte, SessionInboxSize),
+		dispatcher: d,
+	}
+}
+
+func (d *udpDispatcher) dispatchCommand(addr *net.UDPAddr, data []byte) {
+	// Открытую команду мог подделать кто угодно, кто знает адрес клиента
+	if udp.PreSharedKey != nil {
+		sendResponse(d.conn, addr, "ERROR: Server requires encrypted commands, start the client with -psk-file")
+		return
+	}
+	key := addr.String()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sess, ok := d.peers[key]
+	if !ok {
+		sess = d.newSession(addr)
+		d.peers[key] = sess
+		go d.serve(key, sess)
+	}
+	sess.push(data)
+}
+
+func (d *udpDispatcher) dispatchTransfer(addr *net.UDPAddr, data []byte) {
+	h, _, err := udp.DecodeDatagram(data)
+	if err != nil && err != udp.ErrBadChecksum {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err == udp.ErrBadChecksum {
+		// Заголовку верить нельзя, он нужен только чтобы учесть потерю в сессии
+		if sess, ok := d.transfers[h.Session]; ok && sess.addr.String() == addr.String() {
+			sess.corrupt.Add(1)
+		}
+		return
+	}
+
+	if h.Type == udp.MsgOpen && h.Session == 0 {
+		// Повторный MsgOpen (потерялся MsgOpenAck) попадает в уже созданную сессию
+		openKey := fmt.Sprintf("%s/%d", addr, h.Seq)
+		if id, ok := d.opens[openKey]; ok {
+			d.transfers[id].push(data)
+			return
+		}
+
+		sess := d.newSession(addr)
+		sess.token = h.Seq
+		sess.rtt = udp.NewRttEstimator(UdpTimeout)
+		for sess.id == 0 || d.transfers[sess.id] != nil {
+			sess.id = rand.Uint32()
+		}
+		d.transfers[sess.id] = sess
+		d.opens[openKey] = sess.id
+		sess.push(data)
+		go d.runTransfer(openKey, sess)
+		return
+	}
+
+	// Пакеты чужих сессий и подделанные адреса отбрасываем
+	sess, ok := d.transfers[h.Session]
+	if !ok || sess.addr.String() != addr.String() {
+		return
+	}
+	sess.push(data)
+}
+
+// serve runs the text commands of one peer until it stays silent for SessionIdleTimeout
+func (d *udpDispatcher) serve(key string, sess *udpSession) {
+	for {
+		data, err := sess.read(SessionIdleTimeout)
+		if err == errSessionTimeout {
+			d.mu.Lock()
+			// Пока держим блокировку, диспетчер не может положить новый пакет
+			if len(sess.inbox) > 0 {
+				d.mu.Unlock()
+				continue
+			}
+			delete(d.peers, key)
+			d.mu.Unlock()
+			return
+		}
+
+		acc, command, err := d.authenticate(data)
+		if err != nil {
+			sess.respond(fmt.Sprintf("ERROR: %v", err))
+			continue
+		}
+		sess.account = acc
+		processCommand(sess, command)
+	}
+}
+
+// saveLogin issues the token that names acc in later requests
+func (d *udpDispatcher) saveLogin(acc *storage.Account) string {
+	raw := make([]byte, LoginTokenSize)
+	crand.Read(raw)
+	token := hex.EncodeToString(raw)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pruneLogins()
+	d.logins[token] = &udpLogin{account: acc, lastSeen: time.Now()}
+	return token
+}
+
+// authenticate strips the AUTH prefix from a request and returns the account
+// its token names. A request without a token runs as anonymousAccount.
+func (d *udpDispatcher) authenticate(request []byte) (*storage.Account, []byte, error) {
+	rest, ok := bytes.CutPrefix(request, []byte("AUTH "))
+	if !ok {
+		return storage.AnonymousAccount(), request, nil
+	}
+	token, rest, _ := bytes.Cut(rest, []byte(" "))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	login, ok := d.logins[string(token)]
+	if !ok || time.Since(login.lastSeen) > LoginIdleTimeout {
+		delete(d.logins, string(token))
+		return nil, nil, errLoginExpired
+	}
+	login.lastSeen = time.Now()
+	return login.account, rest, nil
+}
+
+func (d *udpDispatcher) pruneLogins() {
+	for key, login := range d.logins {
+		if time.Since(login.lastSeen) > LoginIdleTimeout {
+			delete(d.logins, key)
+		}
+	}
+}
+
+// runTransfer handles the MsgOpen waiting in the inbox and the transfer it starts
+func (d *udpDispatcher) runTransfer(openKey string, sess *udpSession) {
+	defer func() {
+		d.mu.Lock()
+		delete(d.transfers, sess.id)
+		delete(d.opens, openKey)
+		d.mu.Unlock()
+	}()
+
+	data, err := sess.read(UdpTimeout)
+	if err != nil {
+		return
+	}
+	h, payload, err := udp.DecodeDatagram(data)
+	if err != nil {
+		return
+	}
+
+	// Без общего ключа с клиентом сессию не начинаем, ошибка уходит открытым текстом
+	payload, err = sess.acceptOpen(h, payload)
+	if err != nil {
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: "+err.Error()))
+		return
+	}
+
+	acc, payload, err := d.authenticate(payload)
+	if err != nil {
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: %v", err)))
+		return
+	}
+	sess.account = acc
+
+	// Разбиваем запрос так же, как текстовые команды: команда, имя файла, offset
+	parts := strings.SplitN(strings.TrimSpace(string(payload)), " ", 3)
+	command := strings.ToUpper(parts[0])
+	if command == udp.CommandSession {
+		if sess.cipher == nil {
+			sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Text commands of unencrypted clients are sent as plain datagrams"))
+			return
+		}
+		d.runCommand(sess)
+		return
+	}
+	if err := storage.Authorize(sess.account, command); err != nil {
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: %v", err)))
+		return
+	}
+	if len(parts) < 2 {
+		sess.sendMsg(udp.MsgError, sess.token, []byte("ERROR: Filename required"))
+		return
+	}
+
+	switch command {
+	case "UPLOAD":
+		handleUpload(sess, parts[1:])
+	case "DOWNLOAD":
+		handleDownload(sess, parts[1:])
+	default:
+		sess.sendMsg(udp.MsgError, sess.token, []byte(fmt.Sprintf("ERROR: Unknown transfer '%s'", command)))
+	}
+}
+
+// runCommand serves the one text command of an encrypted command session.
+// The command arrives in MsgCommand only after MsgOpenAck, sealed with the
+// session keys, so a recorded command cannot be replayed into a new session.
+// A repeated MsgCommand gets the saved reply instead of running again.
+func (d *udpDispatcher) runCommand(sess *udpSession) {
+	ready := []byte("READY")
+	sess.sendMsg(udp.MsgOpenAck, sess.token, ready)
+
+	lastActivity := time.Now()
+	for {
+		h, payload, err := sess.readMsg(sess.rtt.Timeout())
+		if err != nil {
+			if sess.reply != nil && time.Since(lastActivity) > CloseLinger {
+				return
+			}
+			if time.Since(lastActivity) > SessionIdleTimeout {
+				return
+			}
+			continue
+		}
+		lastActivity = time.Now()
+
+		switch {
+		case h.Type == udp.MsgOpen && sess.reply == nil:
+			// Клиент не получил MsgOpenAck
+			sess.sendMsg(udp.MsgOpenAck, sess.token, ready)
+		case h.Type == udp.MsgCommand && sess.reply == nil:
+			sess.replySeq = h.Seq
+			acc, command, err := d.authenticate(payload)
+			if err != nil {
+				sess.respond(fmt.Sprintf("ERROR: %v", err))
+				continue
+			}
+			sess.account = acc
+			processCommand(sess, command)
+		case h.Type == udp.MsgCommand && h.Seq == sess.replySeq:
+			sess.sendMsg(udp.MsgReply, sess.replySeq, sess.reply)
+		}
+	}
+}
+
+func (s *udpSession) push(data []byte) {
+	select {
+	case s.inbox <- data:
+	default:
+		// Сессия не успевает разбирать очередь, отправитель повторит пакет
+	}
+}
+
+func (s *udpSession) read(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case data := <-s.inbox:
+		return data, nil
+	case <-timer.C:
+		return nil, errSessionTimeout
+	}
+}
+
+// readMsg returns the next transfer datagram of the session, skipping malformed ones
+func (s *udpSession) readMsg(timeout time.Duration) (udp.Header, []byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		data, err := s.read(time.Until(deadline))
+		if err != nil {
+			return udp.Header{}, nil, err
+		}
+
+		h, payload, err := udp.DecodeDatagram(data)
+		if err != nil {
+			continue
+		}
+		if payload, err = s.unseal(h, payload); err == nil {
+			return h, payload, nil
+		}
+	}
+}
+
+// acceptOpen checks that the client uses the same mode as the server and
+// sets up the session cipher from a sealed MsgOpen. It returns the request.
+func (s *udpSession) acceptOpen(h udp.Header, payload []byte) ([]byte, error) {
+	switch {
+	case udp.PreSharedKey == nil && h.Sealed:
+		return nil, errors.New("Encrypted transfers are not enabled on the server")
+	case udp.PreSharedKey == nil:
+		return payload, nil
+	case !h.Sealed:
+		return nil, errors.New("Server requires encrypted transfers")
+	case len(payload) < udp.SaltSize:
+		return nil, errors.New("Malformed encrypted open request")
+	}
+
+	c, err := udp.NewCipher(udp.PreSharedKey, payload[:udp.SaltSize], true)
+	if err != nil {
+		return nil, err
+	}
+	request, err := c.Open(h, payload[udp.SaltSize:])
+	if err != nil {
+		return nil, errors.New("Transfer authentication failed, check the pre-shared key")
+	}
+
+	// Своя соль сервера делает ключи сессии новыми, даже если MsgOpen повторен злоумышленником
+	s.serverSalt = make([]byte, udp.SaltSize)
+	crand.Read(s.serverSalt)
+	if err := c.StartSession(s.serverSalt); err != nil {
+		return nil, err
+	}
+	s.cipher = c
+	return request, nil
+}
+
+// unseal decrypts a datagram of an encrypted session, unsealed ones are
+// rejected there. A plaintext session rejects sealed datagrams instead.
+func (s *udpSession) unseal(h udp.Header, payload []byte) ([]byte, error) {
+	if s.cipher == nil {
+		if h.Sealed {
+			return nil, udp.ErrBadSeal
+		}
+		return payload, nil
+	}
+
+	// Повторный MsgOpen несет ту же соль перед счетчиком
+	if h.Type == udp.MsgOpen {
+		if len(payload) < udp.SaltSize {
+			return nil, udp.ErrBadSeal
+		}
+		payload = payload[udp.SaltSize:]
+	}
+	return s.cipher.Open(h, payload)
+}
+
+// awaitMsg waits for a datagram of the given type, a MsgError ends the wait early
+func (s *udpSession) awaitMsg(msgType uint8, timeout time.Duration) (udp.Header, []byte, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		h, payload, err := s.readMsg(time.Until(deadline))
+		if err != nil {
+			return h, nil, false
+		}
+		if h.Type == msgType {
+			return h, payload, true
+		}
+		if h.Type == udp.MsgError {
+			fmt.Printf("\nClient %s aborted the transfer: %s\n", s.addr, payload)
+			return h, payload, false
+		}
+	}
+}
+
+func (s *udpSession) sendMsg(msgType uint8, seq uint32, payload []byte) bool {
+	var datagram []byte
+	switch {
+	case s.cipher != nil && (msgType == udp.MsgOpenAck || msgType == udp.MsgError):
+		// Клиент узнает соль сервера из первого же ответа, каким бы он ни был
+		datagram = s.cipher.Seal(msgType, s.id, seq, s.serverSalt, payload)
+	case s.cipher != nil:
+		datagram = s.cipher.Seal(msgType, s.id, seq, nil, payload)
+	default:
+		datagram = udp.EncodeDatagram(msgType, s.id, seq, payload)
+	}
+
+	if _, err := s.conn.WriteToUDP(datagram, s.addr); err != nil {
+		fmt.Println("Send error:", err)
+		return false
+	}
+	return true
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"common/storage"
+	"common/tlsconfig"
+	"common/udp"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"server/handlers"
+	"strings"
 	"time"
 )
 
@@ -14,12 +22,63 @@ const (
 	KeepAlivePeriod = 30
 )
 
+var (
+	storageRoot = flag.String("root", ".", "directory that holds uploaded and downloadable files")
+	tlsCert     = flag.String("tls-cert", "", "PEM certificate for the TCP listener, enables TLS")
+	tlsKey      = flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsClientCA = flag.String("tls-client-ca", "", "PEM CA bundle, clients must present a certificate signed by it")
+	usersFile   = flag.String("users", "", "file with user accounts, clients must then LOGIN and are confined to the directory of their role")
+	addUser     = flag.String("add-user", "", "add this user to the -users file with a password read from stdin and exit")
+	role        = flag.String("role", storage.RoleGuest, "role of the user added with -add-user: guest, ingest or admin")
+	pskFile     = flag.String("psk-file", "", "file with a pre-shared key, UDP transfers are then encrypted and must use it")
+)
+
 func main() {
+	flag.IntVar(&udp.MaxWindow, "max-window", udp.MaxWindow, "largest UDP congestion window in chunks")
+	flag.Var(storage.SizeValue(&storage.MaxFileSize), "max-file-size", "largest file a client may upload, e.g. 100M, 0 for unlimited")
+	flag.Var(storage.SizeValue(&storage.GlobalQuota), "quota", "total size of all stored files, e.g. 10G, 0 for unlimited")
+	flag.Var(storage.SizeValue(&storage.DefaultUserQuota), "user-quota", "size of the files under the root of each account unless the users file sets a quota, 0 for unlimited")
+	flag.Parse()
+
+	if *addUser != "" {
+		if err := addUserFromStdin(*usersFile, *addUser, *role); err != nil {
+			log.Fatalf("Could not add user: %v", err)
+		}
+		fmt.Printf("Added %s %s to %s\n", *role, *addUser, *usersFile)
+		return
+	}
+
+	if err := storage.SetRoot(*storageRoot); err != nil {
+		log.Fatalf("Storage error: %v", err)
+	}
+	fmt.Printf("Serving files from %s\n", storage.Root)
+
+	if *usersFile != "" {
+		if err := storage.LoadUsers(*usersFile); err != nil {
+			log.Fatalf("Users error: %v", err)
+		}
+		fmt.Printf("Loaded %d user accounts, clients must log in\n", len(storage.Users))
+	}
+
+	if *pskFile != "" {
+		if err := udp.LoadPreSharedKey(*pskFile); err != nil {
+			log.Fatalf("Key error: %v", err)
+		}
+		fmt.Println("UDP transfers require the pre-shared key")
+	}
+
+	tlsConfig, err := tlsconfig.Server(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatalf("TLS error: %v", err)
+	}
+	// Пароль, защищенный TLS на TCP, не должен уходить открытым текстом по UDP
+	handlers.RefusePlainLogin = tlsConfig != nil && udp.PreSharedKey == nil
+
 	tcpConnChan := make(chan net.Conn)
 	errChan := make(chan error, 2)
 
 	go func() {
-		err := startTcpServer(tcpConnChan)
+		err := startTcpServer(tcpConnChan, tlsConfig)
 		errChan <- err
 	}()
 
@@ -43,14 +102,33 @@ func main() {
 	}
 }
 
-func startTcpServer(tcpConnChan chan net.Conn) error {
+// addUserFromStdin reads the new user's password from the first line of stdin
+func addUserFromStdin(usersFile, name, role string) error {
+	if usersFile == "" {
+		return fmt.Errorf("-add-user requires -users")
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("could not read password: %v", err)
+	}
+	return storage.AddUser(usersFile, name, role, strings.TrimRight(password, "\r\n"))
+}
+
+// startTcpServer accepts TCP connections, wrapped in TLS when tlsConfig is set
+func startTcpServer(tcpConnChan chan net.Conn, tlsConfig *tls.Config) error {
 	ln, err := net.Listen("tcp", TcpHostPort)
 	if err != nil {
 		return fmt.Errorf("Failed to listen: %v", err)
 	}
 	defer ln.Close()
 
-	fmt.Printf("TCP server listening on %s\n", TcpHostPort)
+	if tlsConfig != nil {
+		fmt.Printf("TCP server listening on %s (TLS)\n", TcpHostPort)
+	} else {
+		fmt.Printf("TCP server listening on %s\n", TcpHostPort)
+	}
 
 	for {
 		conn, err := ln.Accept()
@@ -70,6 +148,11 @@ func startTcpServer(tcpConnChan chan net.Conn) error {
 			continue
 		}
 
+		// Рукопожатие TLS произойдет при первом чтении в обработчике
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
+
 		// Отправляем TCP соединение в главный поток для обработки
 		tcpConnChan <- conn
 	}